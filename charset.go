@@ -0,0 +1,52 @@
+package traefik_umami_plugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// the byte order of a UTF-16 body by its BOM, nil if it has none.
+func utf16ByteOrder(body []byte) binary.ByteOrder {
+	if len(body) < 2 {
+		return nil
+	}
+	switch {
+	case body[0] == 0xFF && body[1] == 0xFE:
+		return binary.LittleEndian
+	case body[0] == 0xFE && body[1] == 0xFF:
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// decodes a UTF-16 body with BOM to UTF-8, so the anchors can match.
+func decodeUTF16(body []byte, order binary.ByteOrder) ([]byte, error) {
+	body = body[2:]
+	if len(body)%2 != 0 {
+		return nil, errors.New("incomplete UTF-16 body")
+	}
+	units := make([]uint16, len(body)/2)
+	for i := range units {
+		units[i] = order.Uint16(body[i*2:])
+	}
+	return []byte(string(utf16.Decode(units))), nil
+}
+
+// encodes a UTF-8 body to UTF-16 again, including the BOM.
+func encodeUTF16(body []byte, order binary.ByteOrder) []byte {
+	runes := make([]rune, 0, utf8.RuneCount(body))
+	for len(body) > 0 {
+		r, size := utf8.DecodeRune(body)
+		runes = append(runes, r)
+		body = body[size:]
+	}
+	units := utf16.Encode(runes)
+	encoded := make([]byte, 2+len(units)*2)
+	order.PutUint16(encoded, 0xFEFF)
+	for i, unit := range units {
+		order.PutUint16(encoded[2+i*2:], unit)
+	}
+	return encoded
+}
@@ -0,0 +1,119 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// returned for encodings that can't be decoded, eg. br.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// returned if the decoded body exceeds the limit, eg. for a gzip bomb.
+var errDecodedBodyTooLarge = errors.New("decoded body is too large")
+
+// limit of the decoded body if maxInjectBodyBytes is unlimited.
+const defaultMaxDecodedBodyBytes = 64 << 20
+
+// normalizes the Content-Encoding header, "" is the identity.
+func contentEncoding(header string) string {
+	encoding := strings.ToLower(strings.TrimSpace(header))
+	switch encoding {
+	case "identity":
+		return ""
+	case "x-gzip":
+		return "gzip"
+	}
+	return encoding
+}
+
+// decodes a response body with the content encoding.
+// decoding stops with errDecodedBodyTooLarge after maxBytes.
+func decodeBody(body []byte, encoding string, maxBytes int) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate should be zlib wrapped, but some servers send raw deflate
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// read one byte more than allowed to detect an exceeded limit
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxBytes {
+		return nil, errDecodedBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// encodes a decoded response body again with the content encoding.
+func encodeBody(body []byte, encoding string, gzipPool *gzipWriterPool, level int) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		return gzipPool.compress(body)
+	case "deflate":
+		var buf bytes.Buffer
+		writer, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// gzipWriterPool reuses gzip writers of a single compression level.
+type gzipWriterPool struct {
+	pool sync.Pool
+}
+
+func newGzipWriterPool(level int) *gzipWriterPool {
+	return &gzipWriterPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				// the level is validated in New
+				writer, _ := gzip.NewWriterLevel(io.Discard, level)
+				return writer
+			},
+		},
+	}
+}
+
+// gzip compresses the data with a pooled writer.
+func (p *gzipWriterPool) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := p.pool.Get().(*gzip.Writer)
+	defer p.pool.Put(writer)
+	writer.Reset(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package traefik_umami_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// a value referencing an environment variable, eg. `${UMAMI_WEBSITE_ID}`.
+var envReferenceRegex = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// loads the JSON config file and merges it into the config.
+// file values only fill fields the config leaves at their default.
+// a field explicitly set to its default can't be told apart, so the file overrides it.
+func mergeConfigFile(config *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// the keys present in the file
+	var fileFields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fileFields); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	fileConfig := CreateConfig()
+	if err := json.Unmarshal(data, fileConfig); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	target := reflect.ValueOf(config).Elem()
+	source := reflect.ValueOf(fileConfig).Elem()
+	defaults := reflect.ValueOf(CreateConfig()).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		name := strings.Split(target.Type().Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := fileFields[name]; !ok || name == "configFile" {
+			continue
+		}
+		if isDefaultValue(target.Field(i), defaults.Field(i)) {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
+	return nil
+}
+
+// check if the value is unset, empty slices and maps count as unset.
+func isDefaultValue(value, defaultValue reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		if value.Len() == 0 {
+			return true
+		}
+	}
+	return value.IsZero() || reflect.DeepEqual(value.Interface(), defaultValue.Interface())
+}
+
+// expands the `${ENV_VAR}` references of the secret options,
+// ie. umamiHost, websiteId and serverSideTrackingBearerToken.
+// a reference to an unset variable is emptied, the names of those variables are returned.
+func expandConfigEnv(config *Config) []string {
+	unset := []string{}
+	for _, value := range []*string{&config.UmamiHost, &config.WebsiteId, &config.ServerSideTrackingBearerToken} {
+		match := envReferenceRegex.FindStringSubmatch(*value)
+		if match == nil {
+			continue
+		}
+		expanded, ok := os.LookupEnv(match[1])
+		if !ok {
+			unset = append(unset, match[1])
+		}
+		*value = expanded
+	}
+	return unset
+}
@@ -89,8 +89,38 @@ func removeHeaders(headers http.Header, names ...string) {
 	}
 }
 
+// the scheme the client used, from the first X-Forwarded-Proto, eg. of a load balancer in front,
+// or whether the request came in over TLS.
+func forwardedScheme(req *http.Request) string {
+	if xfp := req.Header.Get(xForwardedProto); xfp != "" {
+		scheme := strings.ToLower(strings.TrimSpace(strings.Split(xfp, ",")[0]))
+		if scheme == "http" || scheme == "https" {
+			return scheme
+		}
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// the host the client requested, from the first X-Forwarded-Host, otherwise the Host.
+func forwardedHost(req *http.Request) string {
+	if xfh := req.Header.Get(xForwardedHost); xfh != "" {
+		if host := strings.TrimSpace(strings.Split(xfh, ",")[0]); host != "" {
+			return host
+		}
+	}
+	return req.Host
+}
+
+// the absolute url of the client request with the request uri, eg. `https://example.com/page?id=1`.
+func absoluteRequestUrl(req *http.Request, requestURI string) string {
+	return forwardedScheme(req) + "://" + forwardedHost(req) + requestURI
+}
+
 func writeXForwardedHeaders(dst http.Header, req *http.Request) {
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+	if clientIP, ok := parseRemoteAddrIP(req.RemoteAddr); ok {
 		if values := req.Header.Values(xForwardedFor); len(values) > 0 {
 			clientIP = strings.Join(values, ", ") + ", " + clientIP
 		}
@@ -142,6 +172,36 @@ func writeXForwardedHeaders(dst http.Header, req *http.Request) {
 	}
 }
 
+// extracts the bare IP of a RemoteAddr.
+// handles IPv4 and IPv6 with or without port (eg. `[::1]:443`) and strips IPv6 zones.
+func parseRemoteAddrIP(remoteAddr string) (string, bool) {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// the IP of the client, the first of the X-Forwarded-For chain, eg. behind a load balancer,
+// otherwise the RemoteAddr.
+func forwardedClientIP(req *http.Request) (string, bool) {
+	if xff := req.Header.Get(xForwardedFor); xff != "" {
+		if clientIP, ok := parseRemoteAddrIP(strings.TrimSpace(strings.Split(xff, ",")[0])); ok {
+			return clientIP, true
+		}
+	}
+	return parseRemoteAddrIP(req.RemoteAddr)
+}
+
 func overrideHeaders(dst, src http.Header, overrideHeaders ...string) {
 	removeHeaders(dst, overrideHeaders...)
 
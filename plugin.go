@@ -3,46 +3,277 @@ package traefik_umami_plugin
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	ForwardPath            string   `json:"forwardPath"`
-	UmamiHost              string   `json:"umamiHost"`
-	WebsiteId              string   `json:"websiteId"`
-	AutoTrack              bool     `json:"autoTrack"`
-	DoNotTrack             bool     `json:"doNotTrack"`
-	Cache                  bool     `json:"cache"`
-	Domains                []string `json:"domains"`
-	EvadeGoogleTagManager  bool     `json:"evadeGoogleTagManager"`
-	ScriptInjection        bool     `json:"scriptInjection"`
-	ScriptInjectionMode    string   `json:"scriptInjectionMode"`
-	ServerSideTracking     bool     `json:"serverSideTracking"`
-	ServerSideTrackingMode string   `json:"serverSideTrackingMode"`
+	ForwardPath                        string            `json:"forwardPath"`
+	UmamiHost                          string            `json:"umamiHost"`
+	WebsiteId                          string            `json:"websiteId"`
+	AutoTrack                          bool              `json:"autoTrack"`
+	AutoTrackEventName                 string            `json:"autoTrackEventName"`
+	DoNotTrack                         bool              `json:"doNotTrack"`
+	Cache                              bool              `json:"cache"`
+	Domains                            []string          `json:"domains"`
+	EvadeGoogleTagManager              bool              `json:"evadeGoogleTagManager"`
+	EvadeObfuscate                     bool              `json:"evadeObfuscate"`
+	ScriptInjection                    bool              `json:"scriptInjection"`
+	ScriptInjectionMode                string            `json:"scriptInjectionMode"`
+	ServerSideTracking                 bool              `json:"serverSideTracking"`
+	ServerSideTrackingMode             string            `json:"serverSideTrackingMode"`
+	ServerSideTrackingFlagBots         bool              `json:"serverSideTrackingFlagBots"`
+	ServerSideTrackingReferrerHostOnly bool              `json:"serverSideTrackingReferrerHostOnly"`
+	GroupByRoutePattern                bool              `json:"groupByRoutePattern"`
+	RoutePatternHeader                 string            `json:"routePatternHeader"`
+	UpstreamTimeout                    string            `json:"upstreamTimeout"`
+	InjectAtLastHead                   bool              `json:"injectAtLastHead"`
+	WebsiteIdBySNI                     map[string]string `json:"websiteIdBySNI"`
+	OptOutPath                         string            `json:"optOutPath"`
+	OptOutCookieName                   string            `json:"optOutCookieName"`
+	GzipLevel                          int               `json:"gzipLevel"`
+	SurrogateKeyHeader                 string            `json:"surrogateKeyHeader"`
+	StripResponseHeaders               []string          `json:"stripResponseHeaders"`
+	RestrictForwardWebsiteId           bool              `json:"restrictForwardWebsiteId"`
+	MaxInjectBodyBytes                 int               `json:"maxInjectBodyBytes"`
+	ConfigFile                         string            `json:"configFile"`
+	AMPMode                            bool              `json:"ampMode"`
+	CSPNonceFromResponse               bool              `json:"cspNonceFromResponse"`
+	UseChunkedEncoding                 bool              `json:"useChunkedEncoding"`
+	InjectMultipart                    bool              `json:"injectMultipart"`
+	TrackDownloads                     bool              `json:"trackDownloads"`
+	DownloadExtensions                 []string          `json:"downloadExtensions"`
+	BufferTimeout                      string            `json:"bufferTimeout"`
+	ServerSideTrackingBearerToken      string            `json:"serverSideTrackingBearerToken"`
+	ServerSideTrackingBearerTokenEnv   string            `json:"serverSideTrackingBearerTokenEnv"`
+	PublicPathPrefix                   string            `json:"publicPathPrefix"`
+	RequireHTMLAccept                  bool              `json:"requireHTMLAccept"`
+	ForwardRateLimit                   float64           `json:"forwardRateLimit"`
+	ForwardRateLimitBurst              int               `json:"forwardRateLimitBurst"`
+	InjectWhenQueryParam               string            `json:"injectWhenQueryParam"`
+	Enabled                            bool              `json:"enabled"`
+	DisabledCollectNoContent           bool              `json:"disabledCollectNoContent"`
+	TrackLanguages                     []string          `json:"trackLanguages"`
+	ServerSideTrackingVisitorHash      bool              `json:"serverSideTrackingVisitorHash"`
+	VisitorHashSalt                    string            `json:"visitorHashSalt"`
+	InjectLimit                        int               `json:"injectLimit"`
+	ScriptHostUrl                      string            `json:"scriptHostUrl"`
+	ServerSideTrackingSink             string            `json:"serverSideTrackingSink"`
+	TrackHeadRequests                  bool              `json:"trackHeadRequests"`
+	AuditTracking                      bool              `json:"auditTracking"`
+	SkipMetaRefresh                    bool              `json:"skipMetaRefresh"`
+	ScriptLoadStrategy                 string            `json:"scriptLoadStrategy"`
+	InjectWhenCookie                   string            `json:"injectWhenCookie"`
+	ForwardExcludeHosts                []string          `json:"forwardExcludeHosts"`
+	DebugHeaders                       bool              `json:"debugHeaders"`
+	UmamiTLSMinVersion                 string            `json:"umamiTLSMinVersion"`
+	ValidateWebsiteIdFormat            bool              `json:"validateWebsiteIdFormat"`
+	ServerSideTrackingParseUTM         bool              `json:"serverSideTrackingParseUTM"`
+	ScriptTemplateFile                 string            `json:"scriptTemplateFile"`
+	ScriptTemplateReloadToken          string            `json:"scriptTemplateReloadToken"`
+	SkipIfScriptsPresent               []string          `json:"skipIfScriptsPresent"`
+	ValidateAfterInjection             bool              `json:"validateAfterInjection"`
+	UseBeacon                          bool              `json:"useBeacon"`
+	ScriptInjectionTarget              string            `json:"scriptInjectionTarget"`
+	TrackNotFound                      bool              `json:"trackNotFound"`
+	ExcludePaths                       []string          `json:"excludePaths"`
+	StrictConfig                       bool              `json:"strictConfig"`
+	ServerSideTrackingMaxLifetime      string            `json:"serverSideTrackingMaxLifetime"`
+	EventNamePrefix                    string            `json:"eventNamePrefix"`
+	ServerSideTrackingStatusClasses    []string          `json:"serverSideTrackingStatusClasses"`
+	TrackingTimeoutSeconds             int               `json:"trackingTimeoutSeconds"`
+	ScriptFetchPriority                string            `json:"scriptFetchPriority"`
+	TrackingWorkers                    int               `json:"trackingWorkers"`
+	RewriteScriptUrls                  bool              `json:"rewriteScriptUrls"`
+	WebsiteIds                         []string          `json:"websiteIds"`
+	WebsiteIdMap                       map[string]string `json:"websiteIdMap"`
+	ServerSideTrackingNotModified      bool              `json:"serverSideTrackingNotModified"`
+	ScriptIntegrity                    string            `json:"scriptIntegrity"`
+	UseFirstDomainAsHostname           bool              `json:"useFirstDomainAsHostname"`
+	CSPNonceHeader                     string            `json:"cspNonceHeader"`
+	CSPGenerateNonce                   bool              `json:"cspGenerateNonce"`
+	HonorControlHeader                 bool              `json:"honorControlHeader"`
+	ControlHeader                      string            `json:"controlHeader"`
+	InjectContentTypes                 []string          `json:"injectContentTypes"`
+	CacheTTLSeconds                    int               `json:"cacheTTLSeconds"`
+	InjectAfterPattern                 string            `json:"injectAfterPattern"`
+	ScriptCacheSize                    int               `json:"scriptCacheSize"`
+	FilterBots                         bool              `json:"filterBots"`
+	BotUserAgents                      []string          `json:"botUserAgents"`
+	InjectMethods                      []string          `json:"injectMethods"`
+	ObfuscateDataAttributes            bool              `json:"obfuscateDataAttributes"`
+	StripQueryParams                   []string          `json:"stripQueryParams"`
+	StripAllQueryParams                bool              `json:"stripAllQueryParams"`
+	LogLevel                           string            `json:"logLevel"`
+	SniffContentType                   bool              `json:"sniffContentType"`
+	Heartbeat                          bool              `json:"heartbeat"`
+	HeartbeatInterval                  string            `json:"heartbeatInterval"`
+	StatsEnabled                       bool              `json:"statsEnabled"`
+	ForwardViaHeader                   bool              `json:"forwardViaHeader"`
+	ReadMetaProperties                 bool              `json:"readMetaProperties"`
+	MetaPropertyPrefix                 string            `json:"metaPropertyPrefix"`
+	UmamiVersion                       string            `json:"umamiVersion"`
+	TrackOnWriteError                  bool              `json:"trackOnWriteError"`
+	ScriptAttributes                   map[string]string `json:"scriptAttributes"`
+	ScriptHostOverride                 string            `json:"scriptHostOverride"`
+	PreventDoubleInjection             bool              `json:"preventDoubleInjection"`
+	StripForwardHeaders                []string          `json:"stripForwardHeaders"`
+	ForwardHeaders                     []string          `json:"forwardHeaders"`
+	EvadeCollectPath                   string            `json:"evadeCollectPath"`
+	TrackingRetries                    int               `json:"trackingRetries"`
+	TrackingRetryDelay                 string            `json:"trackingRetryDelay"`
+	InjectHeadRequests                 bool              `json:"injectHeadRequests"`
+	TrackDomains                       []string          `json:"trackDomains"`
+	ServerSideSessions                 bool              `json:"serverSideSessions"`
+	SessionCookieName                  string            `json:"sessionCookieName"`
+	SessionCookieTTL                   string            `json:"sessionCookieTTL"`
+	MaxInjectBufferBytes               int               `json:"maxInjectBufferBytes"`
+	ScriptInjectionRegex               string            `json:"scriptInjectionRegex"`
+	TrackAbsoluteUrls                  bool              `json:"trackAbsoluteUrls"`
+	ShutdownTimeoutSeconds             int               `json:"shutdownTimeoutSeconds"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		ForwardPath:            "_umami",
-		UmamiHost:              "",
-		WebsiteId:              "",
-		AutoTrack:              true,
-		DoNotTrack:             false,
-		Cache:                  false,
-		Domains:                []string{},
-		EvadeGoogleTagManager:  false,
-		ScriptInjection:        true,
-		ScriptInjectionMode:    SIModeTag,
-		ServerSideTracking:     false,
-		ServerSideTrackingMode: SSTModeAll,
+		ForwardPath:                        "_umami",
+		UmamiHost:                          "",
+		WebsiteId:                          "",
+		AutoTrack:                          true,
+		AutoTrackEventName:                 "",
+		DoNotTrack:                         false,
+		Cache:                              false,
+		Domains:                            []string{},
+		EvadeGoogleTagManager:              false,
+		EvadeObfuscate:                     false,
+		ScriptInjection:                    true,
+		ScriptInjectionMode:                SIModeTag,
+		ServerSideTracking:                 false,
+		ServerSideTrackingMode:             SSTModeAll,
+		ServerSideTrackingFlagBots:         false,
+		ServerSideTrackingReferrerHostOnly: false,
+		GroupByRoutePattern:                false,
+		RoutePatternHeader:                 "X-Route-Pattern",
+		UpstreamTimeout:                    "",
+		InjectAtLastHead:                   false,
+		WebsiteIdBySNI:                     map[string]string{},
+		OptOutPath:                         "",
+		OptOutCookieName:                   "umami_opt_out",
+		GzipLevel:                          6,
+		SurrogateKeyHeader:                 "",
+		StripResponseHeaders:               []string{},
+		RestrictForwardWebsiteId:           false,
+		MaxInjectBodyBytes:                 0,
+		ConfigFile:                         "",
+		AMPMode:                            false,
+		CSPNonceFromResponse:               false,
+		UseChunkedEncoding:                 false,
+		InjectMultipart:                    false,
+		TrackDownloads:                     false,
+		DownloadExtensions:                 []string{".pdf", ".zip", ".dmg", ".exe", ".csv", ".xlsx", ".docx"},
+		BufferTimeout:                      "",
+		ServerSideTrackingBearerToken:      "",
+		ServerSideTrackingBearerTokenEnv:   "",
+		PublicPathPrefix:                   "",
+		RequireHTMLAccept:                  false,
+		ForwardRateLimit:                   0,
+		ForwardRateLimitBurst:              10,
+		InjectWhenQueryParam:               "",
+		Enabled:                            true,
+		DisabledCollectNoContent:           false,
+		TrackLanguages:                     []string{},
+		ServerSideTrackingVisitorHash:      false,
+		VisitorHashSalt:                    "",
+		InjectLimit:                        0,
+		ScriptHostUrl:                      "",
+		ServerSideTrackingSink:             "",
+		TrackHeadRequests:                  false,
+		AuditTracking:                      false,
+		SkipMetaRefresh:                    false,
+		ScriptLoadStrategy:                 SLStrategyEager,
+		InjectWhenCookie:                   "",
+		ForwardExcludeHosts:                []string{},
+		DebugHeaders:                       false,
+		UmamiTLSMinVersion:                 "1.2",
+		ValidateWebsiteIdFormat:            true,
+		ServerSideTrackingParseUTM:         false,
+		ScriptTemplateFile:                 "",
+		ScriptTemplateReloadToken:          "",
+		SkipIfScriptsPresent:               []string{},
+		ValidateAfterInjection:             false,
+		UseBeacon:                          false,
+		ScriptInjectionTarget:              SITargetBodyEnd,
+		TrackNotFound:                      false,
+		ExcludePaths:                       []string{},
+		StrictConfig:                       false,
+		ServerSideTrackingMaxLifetime:      "",
+		EventNamePrefix:                    "",
+		ServerSideTrackingStatusClasses:    []string{},
+		TrackingTimeoutSeconds:             5,
+		ScriptFetchPriority:                "",
+		TrackingWorkers:                    4,
+		RewriteScriptUrls:                  false,
+		WebsiteIds:                         []string{},
+		WebsiteIdMap:                       map[string]string{},
+		ServerSideTrackingNotModified:      true,
+		ScriptIntegrity:                    "",
+		UseFirstDomainAsHostname:           false,
+		CSPNonceHeader:                     "",
+		CSPGenerateNonce:                   false,
+		HonorControlHeader:                 false,
+		ControlHeader:                      "X-Umami-Inject",
+		InjectContentTypes:                 []string{"text/html", "application/xhtml+xml"},
+		CacheTTLSeconds:                    3600,
+		InjectAfterPattern:                 "",
+		ScriptCacheSize:                    100,
+		FilterBots:                         false,
+		BotUserAgents:                      []string{},
+		InjectMethods:                      []string{http.MethodGet},
+		ObfuscateDataAttributes:            false,
+		StripQueryParams:                   []string{},
+		StripAllQueryParams:                false,
+		LogLevel:                           LogLevelInfo,
+		SniffContentType:                   true,
+		Heartbeat:                          false,
+		HeartbeatInterval:                  "30s",
+		StatsEnabled:                       false,
+		ForwardViaHeader:                   false,
+		ReadMetaProperties:                 false,
+		MetaPropertyPrefix:                 "umami:",
+		UmamiVersion:                       UVersion2,
+		TrackOnWriteError:                  true,
+		ScriptAttributes:                   map[string]string{},
+		ScriptHostOverride:                 "",
+		PreventDoubleInjection:             true,
+		StripForwardHeaders:                []string{"Cookie", "Authorization", "Proxy-Authorization"},
+		ForwardHeaders:                     []string{},
+		EvadeCollectPath:                   "data",
+		TrackingRetries:                    2,
+		TrackingRetryDelay:                 "500ms",
+		InjectHeadRequests:                 false,
+		TrackDomains:                       []string{},
+		ServerSideSessions:                 false,
+		SessionCookieName:                  "umami_session",
+		SessionCookieTTL:                   "24h",
+		MaxInjectBufferBytes:               0,
+		ScriptInjectionRegex:               "",
+		TrackAbsoluteUrls:                  false,
+		ShutdownTimeoutSeconds:             5,
 	}
 }
 
@@ -51,16 +282,58 @@ const (
 	SIModeSource       string = "source"
 	SSTModeAll         string = "all"
 	SSTModeNotinjected string = "notinjected"
+	SLStrategyEager    string = "eager"
+	SLStrategyIdle     string = "idle"
+	SITargetHeadStart  string = "head_start"
+	SITargetHeadEnd    string = "head_end"
+	SITargetBodyEnd    string = "body_end"
+	SFPriorityAuto     string = "auto"
+	SFPriorityLow      string = "low"
+	SFPriorityHigh     string = "high"
+	UVersion1          string = "v1"
+	UVersion2          string = "v2"
+	LogLevelDebug      string = "debug"
+	LogLevelInfo       string = "info"
+	LogLevelWarn       string = "warn"
+	LogLevelError      string = "error"
+)
+
+// response headers of the web service for a custom event, eg. `X-Umami-Event: signup`.
+const (
+	eventHeader     = "X-Umami-Event"
+	eventDataHeader = "X-Umami-Event-Data"
 )
 
 // PluginHandler a PluginHandler plugin.
 type PluginHandler struct {
-	next          http.Handler
-	name          string
-	config        Config
-	configIsValid bool
-	scriptHtml    string
-	LogHandler    *log.Logger
+	next                http.Handler
+	name                string
+	config              Config
+	configIsValid       bool
+	configErrors        []string
+	scriptJs            string
+	scriptHtml          string
+	surrogateKey        string
+	allowedWebsiteIds   map[string]bool
+	upstreamTimeout     time.Duration
+	bufferTimeout       time.Duration
+	trackingMaxLifetime time.Duration
+	trackingRetryDelay  time.Duration
+	sessionCookieTTL    time.Duration
+	scriptCache         scriptCache
+	stats               *statsCounters
+	gzipPool            *gzipWriterPool
+	forwardRateLimiter  *rateLimiter
+	injectRemaining     *int64
+	umamiTransport      *http.Transport
+	umamiHttpClient     *http.Client
+	scriptTemplate      *scriptTemplate
+	injectionAnchor     injectionAnchor
+	injectAfterRegex    *regexp.Regexp
+	renderedScripts     *renderedScriptCache
+	workers             *trackingWorkers
+	logSeverity         int
+	LogHandler          *log.Logger
 }
 
 // New created a new Demo plugin.
@@ -72,52 +345,435 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		config:        *config,
 		configIsValid: true,
 		scriptHtml:    "",
+		stats:         &statsCounters{},
+		logSeverity:   logLevelSeverities[LogLevelInfo],
 		LogHandler:    log.New(os.Stdout, "", 0),
 	}
 
+	// merge the config file, the middleware config takes precedence
+	if config.ConfigFile != "" {
+		if err := mergeConfigFile(&h.config, config.ConfigFile); err != nil {
+			h.invalidConfig(fmt.Sprintf("configFile could not be loaded: %+v", err))
+		}
+		merged := h.config
+		config = &merged
+	}
+
+	// expand the environment variables, eg. to keep the website id in a secret
+	bearerTokenIsReference := envReferenceRegex.MatchString(h.config.ServerSideTrackingBearerToken)
+	for _, name := range expandConfigEnv(&h.config) {
+		h.log(LogLevelWarn, fmt.Sprintf("environment variable %s is not set!", name))
+	}
+	expanded := h.config
+	config = &expanded
+
+	// check if logLevel is valid
+	if severity, ok := logLevelSeverities[config.LogLevel]; ok {
+		h.logSeverity = severity
+	} else {
+		h.invalidConfig("logLevel is not valid!")
+	}
 	// check if the umami host is set
 	if config.UmamiHost == "" {
-		h.log("umamiHost is not set!")
-		h.configIsValid = false
+		h.invalidConfig("umamiHost is not set!")
 	}
 	// check if the website id is set
 	if config.WebsiteId == "" {
-		h.log("websiteId is not set!")
-		h.configIsValid = false
+		h.invalidConfig("websiteId is not set!")
 	}
 	// check if scriptInjectionMode is valid
 	if config.ScriptInjectionMode != SIModeTag && config.ScriptInjectionMode != SIModeSource {
-		h.log("scriptInjectionMode is not valid!")
+		h.invalidConfig("scriptInjectionMode is not valid!")
 		h.config.ScriptInjection = false
-		h.configIsValid = false
+	}
+	// the adapter can't run before an inline tracker
+	if config.ObfuscateDataAttributes && config.ScriptInjectionMode == SIModeSource {
+		h.invalidConfig("obfuscateDataAttributes requires scriptInjectionMode tag!")
+		h.config.ObfuscateDataAttributes = false
+	}
+	// check if umamiVersion is valid
+	if config.UmamiVersion != UVersion1 && config.UmamiVersion != UVersion2 {
+		h.invalidConfig("umamiVersion is not valid!")
+	}
+	// check if evadeCollectPath is valid
+	if config.EvadeGoogleTagManager && config.EvadeCollectPath != "" {
+		if !evadeCollectPathRegex.MatchString(config.EvadeCollectPath) || config.EvadeCollectPath == "script.js" || config.EvadeCollectPath == umamiCollectPath(config) {
+			h.invalidConfig("evadeCollectPath is not valid!")
+		}
+	}
+	// check if scriptInjectionTarget is valid
+	anchor, err := parseInjectionTarget(config.ScriptInjectionTarget)
+	if err != nil {
+		h.invalidConfig(fmt.Sprintf("scriptInjectionTarget is not valid: %+v", err))
+		h.config.ScriptInjection = false
+		anchor = injectionTargets[SITargetBodyEnd]
+	}
+	// check if scriptInjectionRegex and injectAfterPattern are combined
+	if config.ScriptInjectionRegex != "" && config.InjectAfterPattern != "" {
+		h.invalidConfig("scriptInjectionRegex and injectAfterPattern can't be combined!")
+	}
+	// check if scriptInjectionRegex is valid, it takes precedence over the scriptInjectionTarget
+	// go regexps run in linear time, so a pattern can't backtrack catastrophically
+	if config.ScriptInjectionRegex != "" {
+		regexAnchor, err := parseInjectionRegex(config.ScriptInjectionRegex)
+		if err != nil {
+			h.invalidConfig(fmt.Sprintf("scriptInjectionRegex is not valid (RE2 syntax, without backreferences or lookarounds): %+v", err))
+			h.config.ScriptInjection = false
+		} else {
+			anchor = regexAnchor
+		}
+	}
+	h.injectionAnchor = anchor
+	// check if injectAfterPattern is valid
+	if config.InjectAfterPattern != "" {
+		h.injectAfterRegex, err = regexp.Compile(config.InjectAfterPattern)
+		if err != nil {
+			h.invalidConfig(fmt.Sprintf("injectAfterPattern is not valid: %+v", err))
+		}
+	}
+	// check if metaPropertyPrefix is set
+	if config.ReadMetaProperties && config.MetaPropertyPrefix == "" {
+		h.invalidConfig("metaPropertyPrefix is not set!")
+	}
+	// check if the scriptAttributes are valid
+	for key := range config.ScriptAttributes {
+		if !scriptAttributeKeyRegex.MatchString(strings.TrimPrefix(strings.ToLower(key), "data-")) {
+			h.invalidConfig(fmt.Sprintf("scriptAttributes %s is not valid!", key))
+		}
+	}
+	// check if scriptLoadStrategy is valid
+	if config.ScriptLoadStrategy != SLStrategyEager && config.ScriptLoadStrategy != SLStrategyIdle {
+		h.invalidConfig("scriptLoadStrategy is not valid!")
+		h.config.ScriptInjection = false
+	}
+	// check if scriptFetchPriority is valid
+	switch config.ScriptFetchPriority {
+	case "", SFPriorityAuto, SFPriorityLow, SFPriorityHigh:
+	default:
+		h.invalidConfig("scriptFetchPriority is not valid!")
+		h.config.ScriptFetchPriority = ""
+	}
+	// check if scriptIntegrity is valid
+	if config.ScriptIntegrity != "" && config.ScriptIntegrity != scriptIntegrityAuto && !isIntegrityHash(config.ScriptIntegrity) {
+		h.invalidConfig("scriptIntegrity is not valid!")
 	}
 	// check if serverSideTrackingMode is valid
 	if config.ServerSideTrackingMode != SSTModeAll && config.ServerSideTrackingMode != SSTModeNotinjected {
-		h.log("serverSideTrackingMode is not valid!")
+		h.invalidConfig("serverSideTrackingMode is not valid!")
 		h.config.ServerSideTracking = false
-		h.configIsValid = false
+	}
+	// check if controlHeader is set
+	if config.HonorControlHeader && config.ControlHeader == "" {
+		h.invalidConfig("controlHeader is not set!")
+	}
+	// check if optOutCookieName is set
+	if config.OptOutPath != "" && config.OptOutCookieName == "" {
+		h.invalidConfig("optOutCookieName is not set!")
+	}
+	// check if gzipLevel is valid
+	if config.GzipLevel < gzip.BestSpeed || config.GzipLevel > gzip.BestCompression {
+		h.invalidConfig("gzipLevel is not valid!")
+	} else {
+		h.gzipPool = newGzipWriterPool(config.GzipLevel)
+	}
+	// check if maxInjectBodyBytes is valid
+	if config.MaxInjectBodyBytes < 0 {
+		h.invalidConfig("maxInjectBodyBytes is not valid!")
+	}
+	// check if maxInjectBufferBytes is valid
+	if config.MaxInjectBufferBytes < 0 {
+		h.invalidConfig("maxInjectBufferBytes is not valid!")
+	}
+	// read the bearer token from the environment, deprecated in favour of a `${ENV_VAR}` reference,
+	// which takes precedence even if its variable is not set
+	if config.ServerSideTrackingBearerTokenEnv != "" {
+		h.log(LogLevelWarn, "serverSideTrackingBearerTokenEnv is deprecated, set serverSideTrackingBearerToken to ${ENV_VAR} instead")
+	}
+	if config.ServerSideTrackingBearerToken == "" && !bearerTokenIsReference && config.ServerSideTrackingBearerTokenEnv != "" {
+		h.config.ServerSideTrackingBearerToken = os.Getenv(config.ServerSideTrackingBearerTokenEnv)
+		if h.config.ServerSideTrackingBearerToken == "" {
+			h.log(LogLevelWarn, fmt.Sprintf("serverSideTrackingBearerTokenEnv %s is not set!", config.ServerSideTrackingBearerTokenEnv))
+		}
+	}
+	// check if the bearer token is set for umami cloud
+	if config.ServerSideTracking && h.config.ServerSideTrackingBearerToken == "" && isUmamiCloudHost(config.UmamiHost) {
+		h.log(LogLevelWarn, "serverSideTrackingBearerToken is not set, umami cloud may reject server side events!")
+	}
+	// check if the forward rate limit is valid
+	if config.ForwardRateLimit < 0 || (config.ForwardRateLimit > 0 && config.ForwardRateLimitBurst < 1) {
+		h.invalidConfig("forwardRateLimit or forwardRateLimitBurst is not valid!")
+	} else if config.ForwardRateLimit > 0 {
+		h.forwardRateLimiter = newRateLimiter(config.ForwardRateLimit, config.ForwardRateLimitBurst)
+	}
+	// generate a salt for the visitor hash if none is configured
+	if config.ServerSideTrackingVisitorHash && config.VisitorHashSalt == "" {
+		salt, err := randomVisitorHashSalt()
+		if err != nil {
+			h.invalidConfig(fmt.Sprintf("Failed to generate visitorHashSalt: %+v", err))
+		} else {
+			h.config.VisitorHashSalt = salt
+			h.log(LogLevelWarn, "visitorHashSalt is not set, visitor hashes change on restart")
+		}
+	}
+	// check if scriptHostOverride is valid
+	if config.ScriptHostOverride != "" && !isAbsoluteUrl(config.ScriptHostOverride) && !strings.HasPrefix(config.ScriptHostOverride, "/") {
+		h.invalidConfig("scriptHostOverride must be an absolute URL or path!")
+	}
+	// check if forwarding is disabled
+	if config.ForwardPath == "" {
+		h.log(LogLevelInfo, "forwardPath is empty, forwarding is disabled")
+		if config.ScriptInjection && config.ScriptHostOverride == "" && !isAbsoluteUrl(config.ScriptHostUrl) {
+			h.invalidConfig("scriptHostUrl must be an absolute URL if forwardPath is empty!")
+		}
+	}
+	// check if the inject limit is valid
+	if config.InjectLimit < 0 {
+		h.invalidConfig("injectLimit is not valid!")
+	}
+	h.injectRemaining = new(int64)
+	*h.injectRemaining = int64(config.InjectLimit)
+	// check if injectWhenQueryParam is valid
+	if config.InjectWhenQueryParam != "" {
+		if _, _, ok := parseNameValue(config.InjectWhenQueryParam); !ok {
+			h.invalidConfig("injectWhenQueryParam is not valid!")
+		}
+	}
+	// check if injectWhenCookie is valid
+	if config.InjectWhenCookie != "" {
+		if _, _, ok := parseNameValue(config.InjectWhenCookie); !ok {
+			h.invalidConfig("injectWhenCookie is not valid!")
+		}
+	}
+	// check if heartbeatInterval is valid
+	if config.Heartbeat {
+		heartbeatInterval, err := time.ParseDuration(config.HeartbeatInterval)
+		if err != nil || heartbeatInterval < time.Second {
+			h.invalidConfig("heartbeatInterval is not valid!")
+		}
+	}
+	// check if bufferTimeout is valid
+	if config.BufferTimeout != "" {
+		bufferTimeout, err := time.ParseDuration(config.BufferTimeout)
+		if err != nil || bufferTimeout < 0 {
+			h.invalidConfig("bufferTimeout is not valid!")
+		}
+		h.bufferTimeout = bufferTimeout
+	}
+	// check if upstreamTimeout is valid
+	if config.UpstreamTimeout != "" {
+		upstreamTimeout, err := time.ParseDuration(config.UpstreamTimeout)
+		if err != nil || upstreamTimeout < 0 {
+			h.invalidConfig("upstreamTimeout is not valid!")
+		}
+		h.upstreamTimeout = upstreamTimeout
+	}
+	// check if trackingRetries and trackingRetryDelay are valid
+	if config.TrackingRetries < 0 {
+		h.invalidConfig("trackingRetries is not valid!")
+	}
+	if config.TrackingRetries > 0 {
+		trackingRetryDelay, err := time.ParseDuration(config.TrackingRetryDelay)
+		if err != nil || trackingRetryDelay < 0 {
+			h.invalidConfig("trackingRetryDelay is not valid!")
+		}
+		h.trackingRetryDelay = trackingRetryDelay
+	}
+	// check if sessionCookieName and sessionCookieTTL are valid
+	if config.ServerSideSessions {
+		if config.SessionCookieName == "" {
+			h.invalidConfig("sessionCookieName is not set!")
+		}
+		sessionCookieTTL, err := time.ParseDuration(config.SessionCookieTTL)
+		if err != nil || sessionCookieTTL < time.Second {
+			h.invalidConfig("sessionCookieTTL is not valid!")
+		}
+		h.sessionCookieTTL = sessionCookieTTL
+	}
+	// check if serverSideTrackingMaxLifetime is valid
+	if config.ServerSideTrackingMaxLifetime != "" {
+		trackingMaxLifetime, err := time.ParseDuration(config.ServerSideTrackingMaxLifetime)
+		if err != nil || trackingMaxLifetime < 0 {
+			h.invalidConfig("serverSideTrackingMaxLifetime is not valid!")
+		}
+		h.trackingMaxLifetime = trackingMaxLifetime
+	}
+	// check if scriptCacheSize is valid
+	if config.ScriptCacheSize < 0 {
+		h.invalidConfig("scriptCacheSize is not valid!")
+	} else if config.ScriptCacheSize > 0 {
+		h.renderedScripts = newRenderedScriptCache(config.ScriptCacheSize)
+	}
+	// check if cacheTTLSeconds is valid
+	if config.CacheTTLSeconds < 0 {
+		h.invalidConfig("cacheTTLSeconds is not valid!")
+	}
+	h.scriptCache.ttl = time.Duration(config.CacheTTLSeconds) * time.Second
+	// check if trackingTimeoutSeconds is valid
+	if config.TrackingTimeoutSeconds < 0 {
+		h.invalidConfig("trackingTimeoutSeconds is not valid!")
+	}
+	// check if shutdownTimeoutSeconds is valid
+	if config.ShutdownTimeoutSeconds < 0 {
+		h.invalidConfig("shutdownTimeoutSeconds is not valid!")
+	}
+	// check if trackingWorkers is valid
+	if config.TrackingWorkers < 1 {
+		h.invalidConfig("trackingWorkers is not valid!")
+	}
+	// check if serverSideTrackingStatusClasses are valid
+	h.config.ServerSideTrackingStatusClasses = []string{}
+	for _, statusClass := range config.ServerSideTrackingStatusClasses {
+		statusClass = strings.ToLower(statusClass)
+		if !statusClassRegex.MatchString(statusClass) {
+			h.invalidConfig(fmt.Sprintf("serverSideTrackingStatusClasses %s is not valid!", statusClass))
+			continue
+		}
+		h.config.ServerSideTrackingStatusClasses = append(h.config.ServerSideTrackingStatusClasses, statusClass)
+	}
+	// check if trackDomains are valid globs
+	h.config.TrackDomains = []string{}
+	for _, pattern := range config.TrackDomains {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			h.invalidConfig(fmt.Sprintf("trackDomains %s is not valid!", pattern))
+			continue
+		}
+		h.config.TrackDomains = append(h.config.TrackDomains, pattern)
+	}
+
+	// hop-by-hop headers and the Content-Length are managed by the plugin
+	h.config.StripResponseHeaders = []string{}
+	for _, header := range config.StripResponseHeaders {
+		if isManagedResponseHeader(header) {
+			h.log(LogLevelWarn, fmt.Sprintf("stripResponseHeaders can't strip %s, ignoring it", header))
+			continue
+		}
+		h.config.StripResponseHeaders = append(h.config.StripResponseHeaders, header)
+	}
+
+	// umami attributes the events to these headers
+	h.config.StripForwardHeaders = []string{}
+	for _, header := range config.StripForwardHeaders {
+		if isRequiredForwardHeader(header) {
+			h.log(LogLevelWarn, fmt.Sprintf("stripForwardHeaders can't strip %s, ignoring it", header))
+			continue
+		}
+		h.config.StripForwardHeaders = append(h.config.StripForwardHeaders, header)
+	}
+
+	// normalize the server names of websiteIdBySNI
+	h.config.WebsiteIdBySNI = map[string]string{}
+	for serverName, websiteId := range config.WebsiteIdBySNI {
+		h.config.WebsiteIdBySNI[strings.ToLower(serverName)] = h.normalizeWebsiteId(websiteId)
+	}
+	// normalize the hosts of websiteIdMap
+	h.config.WebsiteIdMap = map[string]string{}
+	for host, websiteId := range config.WebsiteIdMap {
+		h.config.WebsiteIdMap[strings.ToLower(parseDomainFromHost(host))] = h.normalizeWebsiteId(websiteId)
+	}
+	h.config.WebsiteId = h.normalizeWebsiteId(config.WebsiteId)
+	h.config.WebsiteIds = []string{}
+	for _, websiteId := range config.WebsiteIds {
+		h.config.WebsiteIds = append(h.config.WebsiteIds, h.normalizeWebsiteId(websiteId))
+	}
+
+	h.allowedWebsiteIds = allowedWebsiteIds(&h.config)
+
+	// check if umamiTLSMinVersion is valid
+	tlsMinVersion, ok := tlsVersions[config.UmamiTLSMinVersion]
+	if !ok {
+		h.invalidConfig("umamiTLSMinVersion is not valid!")
+		tlsMinVersion = tlsVersions["1.2"]
+	}
+	h.umamiTransport = newUmamiTransport(tlsMinVersion)
+	h.umamiHttpClient = &http.Client{Transport: h.umamiTransport}
+
+	// load the script template, which replaces the built in script
+	if config.ScriptTemplateFile != "" {
+		h.scriptTemplate, err = loadScriptTemplate(config.ScriptTemplateFile)
+		if err != nil {
+			h.invalidConfig(fmt.Sprintf("scriptTemplateFile could not be loaded: %+v", err))
+		}
+	}
+
+	// fail to load instead of passing through with strictConfig
+	if config.StrictConfig && len(h.configErrors) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(h.configErrors, "; "))
+	}
+
+	// compute the integrity of the script, the tag is rendered without it on failure
+	if config.ScriptIntegrity == scriptIntegrityAuto {
+		h.config.ScriptIntegrity = ""
+		if config.ScriptInjection && config.ScriptInjectionMode == SIModeTag {
+			integrity, err := fetchScriptIntegrity(&h.config, h.umamiClient())
+			if err != nil {
+				h.log(LogLevelWarn, fmt.Sprintf("Could not compute the scriptIntegrity, injecting the script without it: %+v", err))
+			} else {
+				h.config.ScriptIntegrity = integrity
+			}
+			// the hash is not recomputed when the cache refetches the script
+			if config.Cache && config.CacheTTLSeconds > 0 {
+				h.log(LogLevelWarn, "scriptIntegrity auto is computed once at the start, restart the plugin after upgrading Umami, or browsers block the refetched script")
+			}
+		}
 	}
 
 	// build script html
-	scriptHtml, err := buildUmamiScript(&h.config)
-	h.scriptHtml = scriptHtml
+	scriptJs, err := fetchUmamiScriptSource(&h.config, h.umamiClient())
 	if err != nil {
 		return nil, err
 	}
+	h.scriptJs = scriptJs
+	h.scriptHtml = renderUmamiScript(&h.config, scriptJs, defaultScriptParams(&h.config))
+	h.surrogateKey = scriptSurrogateKey(h.scriptHtml)
+
+	// start the workers sending the server side events
+	if (config.ServerSideTracking || config.TrackNotFound) && h.configIsValid {
+		h.startTrackingWorkers(config.TrackingWorkers)
+		// drain the queue when traefik cancels the context, eg. on a reload
+		if done := ctx.Done(); done != nil {
+			go func() {
+				<-done
+				h.Close()
+			}()
+		}
+	}
+
+	// prefetch the script, so the first request is served from cache
+	if h.config.Cache && h.configIsValid {
+		h.warmupScriptCache()
+	}
 
 	/*configJSON, _ := json.Marshal(config)
-	h.log(fmt.Sprintf("config: %s", configJSON))
+	h.log(LogLevelDebug, fmt.Sprintf("config: %s", configJSON))
 	if config.ScriptInjection {
-		h.log(fmt.Sprintf("script: %s", scriptHtml))
+		h.log(LogLevelDebug, fmt.Sprintf("script: %s", scriptHtml))
 	} else {
-		h.log("script: scriptInjection is false")
+		h.log(LogLevelDebug, "script: scriptInjection is false")
 	}*/
 
 	return h, nil
 }
 
-func (h *PluginHandler) log(message string) {
-	level := "info" // default to info
+// logs the configuration problem and disables the plugin.
+func (h *PluginHandler) invalidConfig(message string) {
+	h.log(LogLevelWarn, message)
+	h.configIsValid = false
+	h.configErrors = append(h.configErrors, strings.TrimSuffix(message, "!"))
+}
+
+// the severities of the logLevel, messages below the configured one are dropped.
+var logLevelSeverities = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+func (h *PluginHandler) log(level string, message string) {
+	if logLevelSeverities[level] < h.logSeverity {
+		return
+	}
 	currentTime := time.Now().Format("2006-01-02T15:04:05Z")
 
 	if h.LogHandler != nil {
@@ -126,98 +782,792 @@ func (h *PluginHandler) log(message string) {
 }
 
 func (h *PluginHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.stats.increment(&h.stats.requests)
+
+	// check if the plugin is disabled
+	if !h.config.Enabled {
+		// answer events of already injected pages, so the script treats them as sent
+		if ok, pathAfter := isUmamiForwardPath(req, &h.config); ok && pathAfter == umamiCollectPath(&h.config) && h.config.DisabledCollectNoContent {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+
 	// check if config is valid
 	if !h.configIsValid {
-		h.log("Invalid configuration, passing through request")
+		h.log(LogLevelWarn, "Invalid configuration, passing through request")
 		h.next.ServeHTTP(rw, req)
 		return
 	}
 
+	// Serve the stats, before they could be forwarded to umami
+	if isStatsPath(req, &h.config) {
+		h.serveStats(rw, req)
+		return
+	}
+
 	// Forwarding logic: if request URL matches forwarding path, forward regardless of method
 	if ok, pathAfter := isUmamiForwardPath(req, &h.config); ok {
-		//h.log(fmt.Sprintf("Forward %s", req.URL.EscapedPath()))
+		h.log(LogLevelDebug, fmt.Sprintf("Forward %s", req.URL.EscapedPath()))
+		h.stats.increment(&h.stats.forwardHits)
 		h.forwardToUmami(rw, req, pathAfter)
 		return
 	}
 
-	// For non-GET requests, pass through unmodified
-	if req.Method != http.MethodGet {
-		//h.log(fmt.Sprintf("Non-GET request (%s), passing through", req.Method))
+	// Reload the script template
+	if isTemplateReloadPath(req, &h.config) {
+		h.serveTemplateReload(rw, req)
+		return
+	}
+
+	// Serve the opt-out page
+	if isOptOutPath(req, &h.config) {
+		h.serveOptOut(rw, req)
+		return
+	}
+
+	// Excluded paths are neither injected nor tracked, forwarding is handled above
+	if isExcludedPath(req.URL.Path, h.config.ExcludePaths) {
 		h.next.ServeHTTP(rw, req)
 		return
 	}
 
+	// Upgrades, eg. to a WebSocket, take over the connection and have no page to inject
+	if isUpgradeRequest(req) {
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// HEAD requests have no body to inject, but can be tracked server side
+	// with injectHeadRequests, they are handled like GET requests below
+	if req.Method == http.MethodHead && !h.config.InjectHeadRequests && h.config.TrackHeadRequests && !isOptedOut(req, &h.config) && h.hasInjectCookie(req) && !h.isTurnedOffByControlHeader(req) {
+		sessionId := h.serverSideSession(rw, req)
+		statusCode := h.serveNextWithStatus(rw, req, nil)
+		isHtml := isInjectableContentType(rw.Header().Get("Content-Type"), h.config.InjectContentTypes)
+		trackedStatus := h.isTrackedStatus(statusCode)
+		if isHtml && trackedStatus && h.isTrackedResponse(req, rw.Header(), nil) && shouldServerSideTrack(req, &h.config, false, h) {
+			h.enqueueTracking(req, trackingEvent{websiteId: resolveWebsiteId(req, &h.config), data: map[string]interface{}{}, sessionId: sessionId})
+		}
+		return
+	}
+
+	// For methods other than the injectMethods, opted out visitors, visitors outside the cookie bucket
+	// and requests turned off by another middleware, pass through unmodified
+	isInjectedHead := req.Method == http.MethodHead && h.config.InjectHeadRequests
+	if (!h.isInjectMethod(req.Method) && !isInjectedHead) || isOptedOut(req, &h.config) || !h.hasInjectCookie(req) || h.isTurnedOffByControlHeader(req) {
+		h.log(LogLevelDebug, fmt.Sprintf("Passing through %s %s", req.Method, req.URL.EscapedPath()))
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+
+	websiteId := resolveWebsiteId(req, &h.config)
+	sessionId := h.serverSideSession(rw, req)
+	var routePattern string
+	var metaProperties map[string]interface{}
+	var responseEvent *trackingEvent
+	takeResponseEvent := func(header http.Header) {
+		responseEvent = h.takeResponseEvent(header, websiteId)
+	}
+
 	// For GET requests, process script injection if enabled
 	var injected bool = false
-	if h.config.ScriptInjection {
+	var responseTracked bool = true
+	var statusCode int
+	if h.shouldInject(req) {
 		rb := newResponseBuffer(rw)
-		h.next.ServeHTTP(rb, req)
-		contentType := rb.Header().Get("Content-Type")
-		// Only inject script for 2xx responses with text/html content type
-		// Skip injection for redirects (3xx) and error responses (4xx, 5xx)
-		// Note: statusCode 0 means WriteHeader wasn't called, treat as 200 OK
-		statusCode := rb.statusCode
-		if statusCode == 0 {
-			statusCode = http.StatusOK
-		}
-		isSuccessResponse := statusCode >= 200 && statusCode < 300
-		if isSuccessResponse && strings.HasPrefix(contentType, "text/html") {
-			origBytes := rb.buf.Bytes()
-			newBytes := regexReplaceSingle(origBytes, insertBeforeRegex, h.scriptHtml)
-			if !bytes.Equal(origBytes, newBytes) {
-				rb.buf.Reset()
-				rb.buf.Write(newBytes)
-				injected = true
-				//h.log(fmt.Sprintf("Injected script into %s", req.URL.EscapedPath()))
-			}
-		}
-		rb.Flush()
+		rb.stripHeaders = h.config.StripResponseHeaders
+		rb.maxBytes = h.config.MaxInjectBodyBytes
+		rb.maxUnsized = h.config.MaxInjectBufferBytes
+		rb.chunked = h.config.UseChunkedEncoding
+		rb.injectable = h.isInjectableResponse
+		rb.sniff = h.config.SniffContentType
+		// the page is rendered with a GET, so the headers match those of a GET
+		upstreamReq := req
+		if isInjectedHead {
+			// a response that can't be injected, eg. a large download, is not read to the end
+			upstreamCtx, cancelUpstream := context.WithCancel(req.Context())
+			defer cancelUpstream()
+			rb.headOnly = true
+			rb.cancelUpstream = cancelUpstream
+			upstreamReq = req.Clone(upstreamCtx)
+			upstreamReq.Method = http.MethodGet
+		}
+		inject := func() {
+			routePattern = h.takeRoutePattern(rb.Header())
+			takeResponseEvent(rb.Header())
+			// the checks read the page as it is injected, not compressed or in UTF-16
+			page, decoded := h.decodeBuffer(rb)
+			body := rb.buf.Bytes()
+			if decoded {
+				body = page.body
+			}
+			responseTracked = h.isTrackedResponse(req, rb.Header(), body)
+			if h.config.ReadMetaProperties && responseTracked && decoded && isInjectableContentType(rb.Header().Get("Content-Type"), h.config.InjectContentTypes) {
+				metaProperties = readMetaProperties(page.body, h.config.MetaPropertyPrefix)
+			}
+			status := injectionSkipped
+			if responseTracked && decoded {
+				params := scriptParams{websiteId: websiteId, routePattern: routePattern, origin: "https://" + forwardedHost(req)}
+				if h.config.CSPNonceHeader != "" {
+					params.nonce = req.Header.Get(h.config.CSPNonceHeader)
+				}
+				status = h.injectIntoBuffer(rb, page, params)
+			}
+			// a page already containing a tracker is not tracked again in the notinjected mode
+			injected = status == injectionInjected || status == injectionAlreadyPresent
+			if status == injectionInjected {
+				h.log(LogLevelDebug, fmt.Sprintf("Injected script into %s", req.URL.EscapedPath()))
+			} else {
+				h.stats.incrementSkip(status)
+			}
+			if h.config.DebugHeaders {
+				rb.Header().Set(injectionStatusHeader, status)
+			}
+		}
+		// a response exceeding maxInjectBodyBytes is injected early and streamed
+		rb.onOverflow = inject
+		if !h.serveNextHeadOnly(rb, upstreamReq) {
+			return
+		}
+		if !rb.streaming {
+			inject()
+			rb.flushResponse()
+		}
+		statusCode = rb.statusCode
+		// eg. the client disconnected, the page view is only tracked if configured
+		if err := rb.writeError(); err != nil {
+			h.log(LogLevelDebug, fmt.Sprintf("Could not write the response of %s: %+v", req.URL.EscapedPath(), err))
+			responseTracked = responseTracked && h.config.TrackOnWriteError
+		}
 	} else {
+		if h.config.DebugHeaders {
+			rw.Header().Set(injectionStatusHeader, injectionSkipped)
+		}
+		statusCode = h.serveNextWithStatus(rw, req, takeResponseEvent)
+		routePattern = h.takeRoutePattern(rw.Header())
+		responseTracked = h.isTrackedResponse(req, rw.Header(), nil)
+	}
+
+	// a separate event for broken links
+	if h.config.TrackNotFound && req.Method == http.MethodGet && statusCode == http.StatusNotFound && isTrackedDomain(req, &h.config) {
+		event := trackingEvent{websiteId: websiteId, name: "not_found", data: map[string]interface{}{}, sessionId: sessionId}
+		event.data["path"] = req.URL.Path
+		h.enqueueTracking(req, event)
+	}
+
+	// a custom event of the web service
+	if responseEvent != nil && isTrackedDomain(req, &h.config) {
+		responseEvent.sessionId = sessionId
+		h.enqueueTracking(req, *responseEvent)
+	}
+
+	// Server side tracking for GET requests (and HEAD with injectHeadRequests), other injectMethods are no page views
+	trackedStatus := h.isTrackedStatus(statusCode)
+	isTrackedHead := isInjectedHead && h.config.TrackHeadRequests && isInjectableContentType(rw.Header().Get("Content-Type"), h.config.InjectContentTypes)
+	if (req.Method == http.MethodGet || isTrackedHead) && responseTracked && trackedStatus && shouldServerSideTrack(req, &h.config, injected, h) {
+		event := trackingEvent{websiteId: websiteId, data: map[string]interface{}{}, sessionId: sessionId}
+		for key, value := range metaProperties {
+			event.data[key] = value
+		}
+		if routePattern != "" {
+			event.data["route"] = routePattern
+		}
+		h.enqueueTracking(req, event)
+	}
+}
+
+// check if responses to the method are injected, eg. `PUT` returning html.
+// the request body is passed to the web service untouched.
+func (h *PluginHandler) isInjectMethod(method string) bool {
+	for _, injectMethod := range h.config.InjectMethods {
+		if strings.EqualFold(injectMethod, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if a response with the status code is tracked server side.
+// a 304 is a view of a page cached by the browser.
+func (h *PluginHandler) isTrackedStatus(statusCode int) bool {
+	if statusCode == http.StatusNotModified && !h.config.ServerSideTrackingNotModified {
+		return false
+	}
+	return isTrackedStatus(statusCode, h.config.ServerSideTrackingStatusClasses)
+}
+
+// serves the next handler without buffering.
+// onHeader is called with the response header before it is sent, if set.
+// the status code is only recorded if a feature needs it, otherwise it is 0.
+func (h *PluginHandler) serveNextWithStatus(rw http.ResponseWriter, req *http.Request, onHeader func(http.Header)) int {
+	recordStatus := h.config.TrackNotFound || len(h.config.ServerSideTrackingStatusClasses) > 0 || !h.config.ServerSideTrackingNotModified
+	if !recordStatus && (onHeader == nil || !h.config.ServerSideTracking) {
 		h.next.ServeHTTP(rw, req)
+		return 0
+	}
+	recorder := &statusRecorder{ResponseWriter: rw, onHeader: onHeader}
+	h.next.ServeHTTP(recorder, req)
+	// nothing was written, the header is sent after the handler returns
+	recorder.takeHeader()
+	return recorder.statusCode
+}
+
+// check if the response to the request should be buffered for injection.
+func (h *PluginHandler) shouldInject(req *http.Request) bool {
+	if !h.config.ScriptInjection {
+		return false
+	}
+	if h.config.InjectLimit > 0 && atomic.LoadInt64(h.injectRemaining) <= 0 {
+		return false
+	}
+	if h.config.InjectWhenQueryParam != "" {
+		name, value, _ := parseNameValue(h.config.InjectWhenQueryParam)
+		if req.URL.Query().Get(name) != value {
+			return false
+		}
+	}
+	return !h.config.RequireHTMLAccept || acceptsHTML(req)
+}
+
+// check if the request asks to switch the protocol, eg. `Upgrade: websocket`.
+func isUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != ""
+}
+
+// check if a middleware in front turned off injection and tracking for the request,
+// with the controlHeader set to `off`.
+func (h *PluginHandler) isTurnedOffByControlHeader(req *http.Request) bool {
+	if !h.config.HonorControlHeader {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(req.Header.Get(h.config.ControlHeader)), "off")
+}
+
+// check if the response is a page view that should be injected and tracked.
+// the body is nil if the response was not buffered.
+func (h *PluginHandler) isTrackedResponse(req *http.Request, header http.Header, body []byte) bool {
+	if !isTrackedLanguage(req, header, h.config.TrackLanguages) {
+		return false
+	}
+	return !h.config.SkipMetaRefresh || !isRefreshRedirect(header, body)
+}
+
+var metaRefreshRegex = regexp.MustCompile(`(?i)<meta[^>]+http-equiv=["']?refresh`)
+
+// check if the response redirects with a `Refresh` header or meta tag.
+func isRefreshRedirect(header http.Header, body []byte) bool {
+	return header.Get("Refresh") != "" || metaRefreshRegex.Match(body)
+}
+
+// check if the language of the response is in the tracked languages.
+// uses the Content-Language header, or the first path segment as locale if it is missing.
+// if the list is empty, return true.
+func isTrackedLanguage(req *http.Request, header http.Header, languages []string) bool {
+	if len(languages) == 0 {
+		return true
+	}
+	var responseLanguages []string
+	if contentLanguage := header.Get("Content-Language"); contentLanguage != "" {
+		responseLanguages = strings.Split(contentLanguage, ",")
+	} else {
+		segment := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+		responseLanguages = []string{segment}
+	}
+	for _, responseLanguage := range responseLanguages {
+		responseLanguage = strings.ToLower(strings.TrimSpace(responseLanguage))
+		for _, language := range languages {
+			language = strings.ToLower(language)
+			// `en` also matches regional variants like `en-US`
+			if responseLanguage == language || strings.HasPrefix(responseLanguage, language+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// lowercases website ids, which are UUIDs in umami,
+// and warns about malformed ones if validateWebsiteIdFormat is enabled.
+func (h *PluginHandler) normalizeWebsiteId(websiteId string) string {
+	if !h.config.ValidateWebsiteIdFormat || websiteId == "" {
+		return websiteId
+	}
+	if !uuidRegex.MatchString(websiteId) {
+		h.log(LogLevelWarn, fmt.Sprintf("websiteId %s is not a UUID!", websiteId))
+		return websiteId
+	}
+	return strings.ToLower(websiteId)
+}
+
+// check if the path matches one of the patterns, case insensitive.
+// a pattern matches the path and everything below it, eg. `/admin` matches `/admin/users`.
+// a trailing `*` matches any suffix, eg. `/api*`, other patterns are globs, eg. `/*/health`.
+func isExcludedPath(urlPath string, patterns []string) bool {
+	urlPath = strings.ToLower(urlPath)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "" {
+			continue
+		}
+		prefix := strings.TrimSuffix(pattern, "*")
+		if !strings.ContainsAny(prefix, "*?[") {
+			if prefix != pattern && strings.HasPrefix(urlPath, prefix) {
+				return true
+			}
+			if urlPath == pattern || strings.HasPrefix(urlPath, strings.TrimSuffix(pattern, "/")+"/") {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, urlPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the url has a scheme and a host.
+func isAbsoluteUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// check if the request has the cookie of injectWhenCookie, eg. an experiment bucket.
+// if it is not configured, return true.
+func (h *PluginHandler) hasInjectCookie(req *http.Request) bool {
+	if h.config.InjectWhenCookie == "" {
+		return true
+	}
+	name, value, _ := parseNameValue(h.config.InjectWhenCookie)
+	cookie, err := req.Cookie(name)
+	return err == nil && cookie.Value == value
+}
+
+// splits a `name=value` option.
+func parseNameValue(option string) (string, string, bool) {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// check if the Accept header of the request explicitly includes html.
+// a wildcard like `*/*` doesn't count.
+func acceptsHTML(req *http.Request) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+			if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+				continue
+			}
+			// a quality of 0 means not acceptable
+			rejected := false
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					rejected = err == nil && q == 0
+				}
+			}
+			if !rejected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check if the response can be injected, based on its status and headers.
+// Only inject script for 2xx responses with one of the injectContentTypes
+// Skip injection for redirects (3xx) and error responses (4xx, 5xx)
+func (h *PluginHandler) isInjectableResponse(statusCode int, header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	isSuccessResponse := statusCode >= 200 && statusCode < 300
+	isHtml := isInjectableContentType(contentType, h.config.InjectContentTypes)
+	// multipart responses are skipped by default
+	isMultipart := h.config.InjectMultipart && strings.HasPrefix(strings.ToLower(contentType), "multipart/")
+	return isSuccessResponse && (isHtml || isMultipart)
+}
+
+// describes the reference to a tracker found in the page: the script html, the website id or the script src.
+// a cheap substring scan, returns an empty string if there is none.
+func existingTrackerReference(html []byte, scriptHtml, websiteId string, config *Config) string {
+	if scriptHtml != "" && bytes.Contains(html, []byte(scriptHtml)) {
+		return "the script"
+	}
+	if websiteId != "" && bytes.Contains(html, []byte(websiteId)) {
+		return fmt.Sprintf("the website id %s", websiteId)
+	}
+	src := scriptHostUrl(config) + "/script.js"
+	// the src is html escaped in the injected tag
+	if config.ScriptInjectionMode == SIModeTag && (bytes.Contains(html, []byte(src)) || bytes.Contains(html, []byte(template.HTMLEscapeString(src)))) {
+		return fmt.Sprintf("the script src %s", src)
+	}
+	return ""
+}
+
+// check if the media type of the content type, without parameters like `charset`,
+// starts with one of the content types, case insensitive.
+func isInjectableContentType(contentType string, contentTypes []string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" {
+		return false
+	}
+	for _, injectable := range contentTypes {
+		injectable = strings.ToLower(strings.TrimSpace(injectable))
+		if injectable != "" && strings.HasPrefix(mediaType, injectable) {
+			return true
+		}
+	}
+	return false
+}
+
+// debug response header with the outcome of the injection.
+const injectionStatusHeader = "X-Umami-Injection"
+
+// outcomes of the injection.
+const (
+	injectionInjected       string = "injected"
+	injectionSkipped        string = "skipped"
+	injectionMissingAnchor  string = "missing-anchor"
+	injectionAlreadyPresent string = "already-present"
+	injectionReverted       string = "reverted"
+)
+
+// the buffered page, decoded for the injection.
+type decodedPage struct {
+	body       []byte
+	encoding   string           // the Content-Encoding the page is encoded with again, if any
+	utf16Order binary.ByteOrder // the byte order the page is converted back to UTF-16 with, if any
+}
+
+// decodes the buffered page, compressed pages are decompressed and UTF-16 is converted to UTF-8.
+// returns false if it can't be decoded, eg. the compressed prefix of a streamed page.
+// unsupported encodings like br are not decoded, those pages pass through untouched.
+func (h *PluginHandler) decodeBuffer(rb *responseBuffer) (decodedPage, bool) {
+	page := decodedPage{body: rb.buf.Bytes()}
+	page.encoding = contentEncoding(rb.Header().Get("Content-Encoding"))
+	if page.encoding != "" {
+		// the prefix of a streamed page can't be decoded and encoded again
+		if rb.streaming || h.gzipPool == nil {
+			return page, false
+		}
+		// guards against small bodies expanding to gigabytes
+		maxDecodedBytes := h.config.MaxInjectBodyBytes
+		if maxDecodedBytes <= 0 {
+			maxDecodedBytes = defaultMaxDecodedBodyBytes
+		}
+		decoded, err := decodeBody(page.body, page.encoding, maxDecodedBytes)
+		if err == errDecodedBodyTooLarge {
+			h.log(LogLevelWarn, fmt.Sprintf("Decoded page exceeds %d bytes, passing it through compressed", maxDecodedBytes))
+			return page, false
+		}
+		if err != nil {
+			return page, false
+		}
+		page.body = decoded
+	}
+	// pages in UTF-16 are converted to UTF-8 for the injection, and back afterwards
+	page.utf16Order = utf16ByteOrder(page.body)
+	if page.utf16Order != nil {
+		decoded, err := decodeUTF16(page.body, page.utf16Order)
+		if rb.streaming || err != nil {
+			return page, false
+		}
+		page.body = decoded
+	}
+	return page, true
+}
+
+// injects the script into the decoded page of 2xx html responses.
+// returns the outcome, the body was only modified if it is injectionInjected.
+func (h *PluginHandler) injectIntoBuffer(rb *responseBuffer, page decodedPage, params scriptParams) string {
+	contentType := rb.Header().Get("Content-Type")
+	// Note: statusCode 0 means WriteHeader wasn't called, treat as 200 OK
+	statusCode := rb.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	// multipart responses can't be injected partially
+	isMultipart := strings.HasPrefix(strings.ToLower(contentType), "multipart/")
+	if !h.isInjectableResponse(statusCode, rb.Header()) || (isMultipart && rb.streaming) {
+		return injectionSkipped
 	}
 
-	// Server side tracking for GET requests
-	if shouldServerSideTrack(req, &h.config, injected, h) {
-		go buildAndSendTrackingRequest(req, &h.config)
+	// the headers are final here, the upstream returned or the buffer overflowed
+	// a nonce of the cspNonceHeader request header takes precedence
+	if h.config.CSPNonceFromResponse && params.nonce == "" {
+		params.nonce = cspNonce(rb.Header())
+	}
+	if h.config.CSPGenerateNonce && params.nonce == "" && len(rb.Header().Values("Content-Security-Policy")) > 0 {
+		nonce, err := generateCSPNonce()
+		if err != nil {
+			h.log(LogLevelError, fmt.Sprintf("Could not generate a nonce: %+v", err))
+		} else {
+			params.nonce = nonce
+			addCSPNonce(rb.Header(), nonce)
+		}
+	}
+
+	origBytes := page.body
+
+	// the browser parses XHTML pages as XML, the script must be well-formed
+	params.xhtml = strings.HasPrefix(strings.ToLower(contentType), "application/xhtml+xml")
+
+	// the page was already processed, eg. by chained middlewares, or includes the tracker itself
+	scriptHtml := h.scriptHtmlFor(params)
+	if h.config.PreventDoubleInjection {
+		if reference := existingTrackerReference(origBytes, scriptHtml, params.websiteId, &h.config); reference != "" {
+			h.log(LogLevelDebug, fmt.Sprintf("Skipped injection, the page already contains %s", reference))
+			return injectionAlreadyPresent
+		}
+	}
+	// competing analytics, eg. during a migration
+	for _, script := range h.config.SkipIfScriptsPresent {
+		if script != "" && bytes.Contains(origBytes, []byte(script)) {
+			h.log(LogLevelDebug, fmt.Sprintf("Skipped injection, the page contains %s", script))
+			return injectionSkipped
+		}
+	}
+
+	// reserve one of the remaining injections, concurrent responses can't exceed the limit
+	if h.config.InjectLimit > 0 && atomic.AddInt64(h.injectRemaining, -1) < 0 {
+		atomic.AddInt64(h.injectRemaining, 1)
+		return injectionSkipped
+	}
+
+	inject := func(html []byte) []byte {
+		if h.config.AMPMode && isAMPDocument(html) {
+			return h.injectAMP(html, params)
+		}
+		return h.injectScript(html, scriptHtml)
+	}
+	var newBytes []byte
+	if isMultipart {
+		newBytes = injectMultipart(origBytes, contentType, h.config.InjectContentTypes, inject)
+	} else {
+		newBytes = inject(origBytes)
+	}
+	if bytes.Equal(origBytes, newBytes) {
+		h.releaseInjection()
+		return injectionMissingAnchor
+	}
+	if h.config.ValidateAfterInjection && !isValidInjection(origBytes, newBytes, h.injectionAnchor.regex) {
+		h.log(LogLevelWarn, "Reverted injection, the page is malformed after injecting")
+		h.releaseInjection()
+		return injectionReverted
+	}
+	if page.utf16Order != nil {
+		newBytes = encodeUTF16(newBytes, page.utf16Order)
+	}
+	if page.encoding != "" {
+		encoded, err := encodeBody(newBytes, page.encoding, h.gzipPool, h.config.GzipLevel)
+		if err != nil {
+			h.releaseInjection()
+			return injectionSkipped
+		}
+		newBytes = encoded
 	}
+	rb.replaceBody(newBytes)
+	h.stats.increment(&h.stats.injected)
+	h.addSurrogateKey(rb.Header())
+	return injectionInjected
 }
 
-// responseBuffer buffers the response for script injection.
-type responseBuffer struct {
-	rw          http.ResponseWriter
-	buf         *bytes.Buffer
-	statusCode  int
-	wroteHeader bool
+// gives back an injection reserved from the injectLimit, if the page was not injected.
+func (h *PluginHandler) releaseInjection() {
+	if h.config.InjectLimit > 0 {
+		atomic.AddInt64(h.injectRemaining, 1)
+	}
+}
+
+// returns the script html for the script params.
+// Only renders the script if the params differ from the defaults.
+func (h *PluginHandler) scriptHtmlFor(params scriptParams) string {
+	if h.scriptTemplate != nil {
+		html, err := h.scriptTemplate.render(h.scriptTemplateData(params))
+		if err != nil {
+			h.log(LogLevelError, fmt.Sprintf("scriptTemplateFile could not be rendered: %+v", err))
+		}
+		return html
+	}
+	// the origin is only rendered into amp-analytics
+	params.origin = ""
+	if params == defaultScriptParams(&h.config) {
+		return h.scriptHtml
+	}
+	// a nonce differs per request, caching the script is pointless
+	if h.renderedScripts != nil && params.nonce == "" {
+		key := renderedScriptKey{websiteId: params.websiteId, routePattern: params.routePattern, xhtml: params.xhtml}
+		return h.renderedScripts.get(key, func() string {
+			return renderUmamiScript(&h.config, h.scriptJs, params)
+		})
+	}
+	return renderUmamiScript(&h.config, h.scriptJs, params)
 }
 
-func newResponseBuffer(rw http.ResponseWriter) *responseBuffer {
-	return &responseBuffer{
-		rw:  rw,
-		buf: &bytes.Buffer{},
+// inserts the script after the first match of the injectAfterPattern,
+// otherwise at the first or last anchor of the page.
+func (h *PluginHandler) injectScript(body []byte, scriptHtml string) []byte {
+	if h.injectAfterRegex != nil {
+		if match := h.injectAfterRegex.FindIndex(body); match != nil {
+			if index := afterElementIndex(body, match[1]); isTagBoundary(body, index) {
+				return insertAt(body, index, scriptHtml)
+			}
+		}
+	}
+	return h.injectAt(body, scriptHtml, h.injectionAnchor)
+}
+
+func (h *PluginHandler) injectAt(body []byte, html string, anchor injectionAnchor) []byte {
+	if h.config.InjectAtLastHead {
+		return regexReplaceLast(body, anchor, html)
+	}
+	return regexReplaceSingle(body, anchor, html)
+}
+
+// adds the surrogate key of the script to the response,
+// keeping the keys the web service already set.
+func (h *PluginHandler) addSurrogateKey(header http.Header) {
+	if h.config.SurrogateKeyHeader == "" {
+		return
+	}
+	surrogateKey := h.surrogateKey
+	if h.scriptTemplate != nil {
+		surrogateKey = h.scriptTemplate.key()
+	}
+	if keys := header.Get(h.config.SurrogateKeyHeader); keys != "" {
+		header.Set(h.config.SurrogateKeyHeader, keys+" "+surrogateKey)
+		return
 	}
+	header.Set(h.config.SurrogateKeyHeader, surrogateKey)
 }
 
-func (rb *responseBuffer) Header() http.Header {
-	return rb.rw.Header()
+// reads the route pattern provided by the web service and removes it from the response.
+func (h *PluginHandler) takeRoutePattern(header http.Header) string {
+	if !h.config.GroupByRoutePattern {
+		return ""
+	}
+	routePattern := header.Get(h.config.RoutePatternHeader)
+	header.Del(h.config.RoutePatternHeader)
+	return routePattern
 }
 
-func (rb *responseBuffer) WriteHeader(statusCode int) {
-	if !rb.wroteHeader {
-		rb.statusCode = statusCode
-		rb.wroteHeader = true
+// takes the custom event the web service set in the eventHeader response header.
+// the headers are removed from the response, invalid event data is logged and left out.
+func (h *PluginHandler) takeResponseEvent(header http.Header, websiteId string) *trackingEvent {
+	if !h.config.ServerSideTracking {
+		return nil
+	}
+	name := header.Get(eventHeader)
+	eventData := header.Get(eventDataHeader)
+	header.Del(eventHeader)
+	header.Del(eventDataHeader)
+	if name == "" {
+		return nil
 	}
+	event := &trackingEvent{websiteId: websiteId, name: name, data: map[string]interface{}{}}
+	if eventData != "" {
+		if err := json.Unmarshal([]byte(eventData), &event.data); err != nil {
+			h.log(LogLevelWarn, fmt.Sprintf("%s is not a JSON object, sending %s without data: %+v", eventDataHeader, name, err))
+			event.data = map[string]interface{}{}
+		}
+	}
+	return event
 }
 
-func (rb *responseBuffer) Write(p []byte) (int, error) {
-	return rb.buf.Write(p)
+// serveNextHeadOnly runs serveNextBuffered, and recovers from the abort of a proxying upstream
+// when the buffer canceled the request of a HEAD, the headers are sent then.
+func (h *PluginHandler) serveNextHeadOnly(rb *responseBuffer, req *http.Request) (served bool) {
+	if !rb.headOnly {
+		return h.serveNextBuffered(rb, req)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler || !rb.isUpstreamCanceled() {
+				panic(p)
+			}
+			rb.finish()
+			served = true
+		}
+	}()
+	return h.serveNextBuffered(rb, req)
 }
 
-func (rb *responseBuffer) Flush() {
-	if !rb.wroteHeader {
-		rb.statusCode = http.StatusOK
+// serveNextBuffered runs the next handler into the response buffer.
+// If a bufferTimeout is configured, the buffered part of a slow response
+// is injected and flushed once the budget is exceeded, the rest is streamed.
+// If an upstreamTimeout is configured, the next handler runs under a watchdog:
+// when it does not return in time, the buffer is detached, 504 is written
+// to the client and false is returned.
+func (h *PluginHandler) serveNextBuffered(rb *responseBuffer, req *http.Request) bool {
+	if h.upstreamTimeout <= 0 && h.bufferTimeout <= 0 {
+		h.next.ServeHTTP(rb, req)
+		return true
+	}
+
+	// the upstream gets its own header map, so it can't touch
+	// the client response after a timeout fired
+	rb.header = http.Header{}
+
+	// without an upstreamTimeout, the upstream is waited for, even if the client went away
+	ctx := req.Context()
+	var upstreamTimedOut <-chan struct{}
+	if h.upstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(req.Context(), h.upstreamTimeout)
+		defer cancel()
+		upstreamTimedOut = ctx.Done()
+	}
+	var bufferTimedOut <-chan time.Time
+	if h.bufferTimeout > 0 {
+		timer := time.NewTimer(h.bufferTimeout)
+		defer timer.Stop()
+		bufferTimedOut = timer.C
+	}
+
+	// the upstream runs on its own goroutine, so the buffered part
+	// can be flushed while the upstream is still blocked
+	done := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			done <- recover()
+		}()
+		h.next.ServeHTTP(rb, req.WithContext(ctx))
+	}()
+
+	for {
+		select {
+		case p := <-done:
+			if p != nil {
+				// re-panic on the request goroutine, so it's handled like a panic of the next handler
+				panic(p)
+			}
+			rb.finish()
+			return true
+		case <-bufferTimedOut:
+			bufferTimedOut = nil
+			rb.streamOnTimeout()
+		case <-upstreamTimedOut:
+			// the client went away, there is no one to respond to
+			if req.Context().Err() != nil || ctx.Err() != context.DeadlineExceeded {
+				h.log(LogLevelDebug, fmt.Sprintf("Client canceled %s, aborting request", req.URL.EscapedPath()))
+				rb.abort()
+				return false
+			}
+			h.log(LogLevelWarn, fmt.Sprintf("Upstream did not respond within %s, aborting request", h.upstreamTimeout))
+			// the response is already partially streamed, it can only be cut off
+			if rb.abort() {
+				return false
+			}
+			rb.rw.WriteHeader(http.StatusGatewayTimeout)
+			return false
+		}
 	}
-	// Update Content-Length header to match actual body size after potential modification
-	rb.rw.Header().Set("Content-Length", fmt.Sprintf("%d", rb.buf.Len()))
-	rb.rw.WriteHeader(rb.statusCode)
-	rb.rw.Write(rb.buf.Bytes())
 }
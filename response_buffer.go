@@ -0,0 +1,389 @@
+package traefik_umami_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// check if the header is hop-by-hop or the Content-Length.
+func isManagedResponseHeader(header string) bool {
+	if strings.EqualFold(header, "Content-Length") {
+		return true
+	}
+	for _, hopHeader := range hopHeaders {
+		if strings.EqualFold(header, hopHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseBuffer buffers the response for script injection.
+type responseBuffer struct {
+	rw           http.ResponseWriter
+	buf          *bytes.Buffer
+	header       http.Header // if set, used instead of the header of rw, until the upstream returned
+	statusCode   int
+	wroteHeader  bool
+	mu           sync.Mutex
+	aborted      bool
+	stripHeaders []string // removed from the response in flushResponse
+	maxBytes     int      // 0 buffers the whole body
+	maxUnsized   int      // limit of bodies without a Content-Length, 0 uses maxBytes
+	onOverflow   func()   // called with the buffered prefix, before streaming starts
+	streaming    bool     // the buffer overflowed, writes go to rw
+	chunked      bool     // respond without Content-Length
+	done         bool     // the upstream returned
+	timedOut     bool     // the bufferTimeout fired before the upstream wrote, its first write or flush starts streaming
+	sniff        bool     // detects a missing Content-Type from the first write
+	modified     bool     // the buffered body was replaced, eg. by the injection
+	writeErr     error    // the first failed write to the client, eg. after a disconnect
+	headOnly     bool     // responds the headers of the buffered body, without the body, eg. to a HEAD
+	// with headOnly, cancels the upstream request once the response passes through
+	cancelUpstream   func()
+	upstreamCanceled bool
+	// reports if the response can be injected, other responses pass through right away
+	injectable func(statusCode int, header http.Header) bool
+}
+
+func newResponseBuffer(rw http.ResponseWriter) *responseBuffer {
+	return &responseBuffer{
+		rw:  rw,
+		buf: &bytes.Buffer{},
+	}
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	if rb.header != nil {
+		return rb.header
+	}
+	return rb.rw.Header()
+}
+
+func (rb *responseBuffer) WriteHeader(statusCode int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if !rb.wroteHeader && !rb.aborted {
+		rb.statusCode = statusCode
+		rb.wroteHeader = true
+	}
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.aborted {
+		return 0, http.ErrHandlerTimeout
+	}
+	if rb.upstreamCanceled {
+		return 0, errUpstreamCanceled
+	}
+	if rb.streaming {
+		return rb.writeToClient(p)
+	}
+	if rb.timedOut {
+		rb.buf.Write(p)
+		rb.startStreaming()
+		return len(p), nil
+	}
+	if rb.sniff && rb.buf.Len() == 0 {
+		rb.sniffContentType(p)
+	}
+	// eg. event streams, which must reach the client immediately
+	if !rb.isInjectable() {
+		rb.startStreaming()
+		if rb.stopHeadOnlyUpstream() {
+			return 0, errUpstreamCanceled
+		}
+		return rb.writeToClient(p)
+	}
+	if maxBytes := rb.bufferLimit(); maxBytes > 0 && rb.buf.Len()+len(p) > maxBytes {
+		rb.buf.Write(p)
+		rb.startStreaming()
+		return len(p), nil
+	}
+	return rb.buf.Write(p)
+}
+
+// the number of bytes buffered before streaming starts, 0 is unlimited.
+// a streamed body of unknown length is limited to maxUnsized, if it is lower.
+func (rb *responseBuffer) bufferLimit() int {
+	if rb.maxUnsized > 0 && (rb.maxBytes == 0 || rb.maxUnsized < rb.maxBytes) && rb.Header().Get("Content-Length") == "" {
+		return rb.maxUnsized
+	}
+	return rb.maxBytes
+}
+
+// sets the Content-Type detected from the first write if the upstream didn't set it,
+// like net/http does on the real writer, so such pages can still be injected.
+func (rb *responseBuffer) sniffContentType(p []byte) {
+	header := rb.Header()
+	if _, haveType := header["Content-Type"]; haveType || len(p) == 0 {
+		return
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Transfer-Encoding") != "" {
+		return
+	}
+	statusCode := rb.statusCode
+	if !rb.wroteHeader {
+		statusCode = http.StatusOK
+	}
+	if (statusCode >= 100 && statusCode < 200) || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		return
+	}
+	header.Set("Content-Type", http.DetectContentType(p))
+}
+
+// Flush implements http.Flusher for streaming upstreams.
+// responses that can't be injected switch to streaming and are flushed,
+// an html page keeps being buffered for the injection.
+func (rb *responseBuffer) Flush() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.aborted {
+		return
+	}
+	if !rb.streaming {
+		if rb.isInjectable() && !rb.timedOut {
+			return
+		}
+		rb.startStreaming()
+		if rb.stopHeadOnlyUpstream() {
+			return
+		}
+	}
+	if flusher, ok := rb.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, if the underlying writer supports it.
+// the connection is handed to the upstream, nothing is flushed afterwards.
+func (rb *responseBuffer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	hijacker, ok := rb.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err == nil {
+		rb.streaming = true
+	}
+	return conn, buf, err
+}
+
+// the write error after the upstream request of a HEAD was canceled.
+var errUpstreamCanceled = fmt.Errorf("the body of the HEAD response is not needed")
+
+// with headOnly, cancels the upstream once the headers of a response passing through are sent,
+// so its body, eg. a large download, is not read just to be discarded.
+// returns true if the upstream was canceled.
+func (rb *responseBuffer) stopHeadOnlyUpstream() bool {
+	if !rb.headOnly || rb.cancelUpstream == nil {
+		return false
+	}
+	if !rb.upstreamCanceled {
+		rb.upstreamCanceled = true
+		rb.cancelUpstream()
+	}
+	return true
+}
+
+// check if the upstream request of a HEAD was canceled.
+func (rb *responseBuffer) isUpstreamCanceled() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.upstreamCanceled
+}
+
+// check if the response, as far as it is known, can be injected.
+func (rb *responseBuffer) isInjectable() bool {
+	if rb.injectable == nil {
+		return true
+	}
+	statusCode := rb.statusCode
+	if !rb.wroteHeader {
+		statusCode = http.StatusOK
+	}
+	return rb.injectable(statusCode, rb.Header())
+}
+
+// abort discards all further writes to the buffer.
+// returns true if the response is already streaming.
+func (rb *responseBuffer) abort() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.aborted = true
+	return rb.streaming
+}
+
+// finish marks the upstream as returned and hands the headers to rw.
+// a streamed response already sent its headers, only the ones added since,
+// eg. trailers, are handed over.
+func (rb *responseBuffer) finish() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.done = true
+	if rb.header == nil {
+		return
+	}
+	if rb.streaming {
+		for key, values := range rb.header {
+			if _, ok := rb.rw.Header()[key]; !ok {
+				rb.rw.Header()[key] = values
+			}
+		}
+	} else {
+		copyHeaders(rb.rw.Header(), rb.header)
+	}
+	rb.header = nil
+}
+
+// streamOnTimeout injects and flushes the buffered part once the bufferTimeout fired,
+// while the upstream is still running, and streams the rest.
+// the upstream writes to its own header map, which is only copied once it wrote
+// the headers. before, they may still change, so its first write or flush starts streaming.
+func (rb *responseBuffer) streamOnTimeout() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.aborted || rb.streaming || rb.done {
+		return
+	}
+	rb.timedOut = true
+	if !rb.wroteHeader && rb.buf.Len() == 0 {
+		return
+	}
+	rb.startStreaming()
+}
+
+// startStreaming gives up buffering: the buffered prefix is passed to
+// onOverflow, written to the client, and all further writes go to rw.
+func (rb *responseBuffer) startStreaming() {
+	rb.streaming = true
+	if rb.onOverflow != nil {
+		rb.onOverflow()
+	}
+	// the upstream keeps its own header map, so it can't touch the client response,
+	// eg. after an upstreamTimeout aborted the request
+	if rb.header != nil {
+		copyHeaders(rb.rw.Header(), rb.header)
+	}
+	// the final length is unknown if the prefix was modified
+	if rb.modified {
+		rb.rw.Header().Del("Content-Length")
+	}
+	if !rb.wroteHeader {
+		rb.statusCode = http.StatusOK
+		rb.wroteHeader = true
+	}
+	removeHeaders(rb.rw.Header(), rb.stripHeaders...)
+	rb.rw.WriteHeader(rb.statusCode)
+	rb.writeToClient(rb.buf.Bytes())
+	rb.buf.Reset()
+	// flush, so the client receives the part without waiting for the rest
+	if flusher, ok := rb.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// replaces the buffered body, eg. with the injected page.
+func (rb *responseBuffer) replaceBody(body []byte) {
+	rb.buf.Reset()
+	rb.buf.Write(body)
+	rb.modified = true
+}
+
+// statusRecorder records the status code of a response passed through.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	// called once before the headers are sent, eg. to take plugin headers
+	onHeader func(header http.Header)
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+		r.takeHeader()
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+		r.takeHeader()
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses working.
+func (r *statusRecorder) Flush() {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+		r.takeHeader()
+	}
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) takeHeader() {
+	if r.onHeader != nil {
+		r.onHeader(r.Header())
+		r.onHeader = nil
+	}
+}
+
+// flushResponse writes the status, headers and the complete body to the client.
+// Nothing reaches the client before, so the Content-Length of a modified body
+// always matches it. A Flush of the upstream doesn't write a partial html response.
+func (rb *responseBuffer) flushResponse() {
+	if !rb.wroteHeader {
+		rb.statusCode = http.StatusOK
+	}
+	removeHeaders(rb.rw.Header(), rb.stripHeaders...)
+	if rb.chunked {
+		// flushing the headers without a length makes net/http use chunked encoding
+		rb.rw.Header().Del("Content-Length")
+		rb.rw.WriteHeader(rb.statusCode)
+		if flusher, ok := rb.rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		rb.writeToClient(rb.buf.Bytes())
+		return
+	}
+	// Update Content-Length header to match the body size after the modification
+	// unmodified responses, and responses without a body, eg. a 304, keep the headers of the upstream
+	if rb.modified && rb.statusCode != http.StatusNotModified && rb.statusCode != http.StatusNoContent {
+		rb.rw.Header().Set("Content-Length", fmt.Sprintf("%d", rb.buf.Len()))
+	}
+	rb.rw.WriteHeader(rb.statusCode)
+	rb.writeToClient(rb.buf.Bytes())
+}
+
+// writes to the client and records the first error.
+// a failed write is not retried, so the client never gets a part twice.
+func (rb *responseBuffer) writeToClient(p []byte) (int, error) {
+	if rb.headOnly {
+		return len(p), nil
+	}
+	n, err := rb.rw.Write(p)
+	if err != nil && rb.writeErr == nil {
+		rb.writeErr = err
+	}
+	return n, err
+}
+
+// the first error writing to the client.
+func (rb *responseBuffer) writeError() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.writeErr
+}
@@ -0,0 +1,80 @@
+package traefik_umami_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// matches the html tag of AMP documents, `<html ⚡>` or `<html amp>`.
+var ampDocumentRegex = regexp.MustCompile(`(?i)<html[^>]*\s(?:⚡|amp)[\s=/>]`)
+
+var headEndRegex = regexp.MustCompile(`(?i)</head>`)
+
+const ampAnalyticsExtensionHtml = `<script async custom-element="amp-analytics" src="https://cdn.ampproject.org/v0/amp-analytics-0.1.js"></script>`
+
+var ampAnalyticsExtensionRegex = regexp.MustCompile(`custom-element=["']?amp-analytics`)
+
+// check if the html is an AMP document.
+func isAMPDocument(body []byte) bool {
+	return ampDocumentRegex.Match(body)
+}
+
+// the absolute https url of the collect endpoint for amp-analytics.
+// pages served from an AMP cache resolve relative urls against the cache,
+// so a relative scriptHostUrl is prefixed with the origin of the page.
+func ampCollectUrl(config *Config, params scriptParams) string {
+	hostUrl := scriptHostUrl(config)
+	if !isAbsoluteUrl(hostUrl) {
+		hostUrl = params.origin + "/" + strings.TrimPrefix(hostUrl, "/")
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(hostUrl, "/"), browserCollectPath(config))
+}
+
+// builds the amp-analytics element sending page views to the forward path.
+// AMP has no umami vendor, so the request is configured explicitly.
+func buildUmamiAMPAnalytics(config *Config, params scriptParams) string {
+	ampConfig := map[string]interface{}{
+		"requests": map[string]string{
+			"pageview": ampCollectUrl(config, params),
+		},
+		"triggers": map[string]interface{}{
+			"trackPageview": map[string]string{
+				"on":      "visible",
+				"request": "pageview",
+			},
+		},
+		"transport": map[string]bool{
+			"beacon":  true,
+			"xhrpost": true,
+			"image":   false,
+			"useBody": true,
+		},
+		"extraUrlParams": map[string]interface{}{
+			"type": "event",
+			"payload": map[string]string{
+				"website":  params.websiteId,
+				"hostname": "${sourceHost}",
+				"url":      "${sourcePath}",
+				"referrer": "${documentReferrer}",
+				"language": "${browserLanguage}",
+				"title":    "${title}",
+				"screen":   "${screenWidth}x${screenHeight}",
+			},
+		},
+	}
+	// json.Marshal escapes <, > and &, so the config can't close the script tag
+	ampConfigJson, _ := json.Marshal(ampConfig)
+	return fmt.Sprintf(`<amp-analytics><script type="application/json">%s</script></amp-analytics>`, ampConfigJson)
+}
+
+// injects the amp-analytics element and its extension script into an AMP document.
+func (h *PluginHandler) injectAMP(body []byte, params scriptParams) []byte {
+	// amp-analytics is only valid in the body
+	injected := h.injectAt(body, buildUmamiAMPAnalytics(&h.config, params), injectionTargets[SITargetBodyEnd])
+	if ampAnalyticsExtensionRegex.Match(injected) {
+		return injected
+	}
+	return regexReplaceSingle(injected, injectionAnchor{regex: headEndRegex}, ampAnalyticsExtensionHtml)
+}
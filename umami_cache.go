@@ -0,0 +1,129 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeout for prefetching the umami script in New.
+const scriptCacheWarmupTimeout = 5 * time.Second
+
+// scriptCache holds the umami script served under the forward path.
+type scriptCache struct {
+	mu       sync.RWMutex
+	header   http.Header
+	body     []byte
+	etag     string
+	storedAt time.Time
+	ttl      time.Duration // 0 never expires
+}
+
+// cache the script response.
+func (c *scriptCache) store(header http.Header, body []byte) {
+	cachedHeader := http.Header{}
+	copyHeaders(cachedHeader, header)
+	removeHeaders(cachedHeader, hopHeaders...)
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:8]))
+	cachedHeader.Set("ETag", etag)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header = cachedHeader
+	c.body = body
+	c.etag = etag
+	c.storedAt = time.Now()
+}
+
+// write the cached script to the response.
+// responds 304 if the If-None-Match of the request matches the ETag.
+// returns false if nothing is cached yet or the cached script expired.
+func (c *scriptCache) serve(rw http.ResponseWriter, req *http.Request) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.body == nil {
+		return false
+	}
+	remaining := c.ttl - time.Since(c.storedAt)
+	if c.ttl > 0 && remaining <= 0 {
+		return false
+	}
+	copyHeaders(rw.Header(), c.header)
+	if c.ttl > 0 {
+		// browsers keep the script at most until the cached copy expires
+		rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(remaining.Seconds())))
+	}
+	if etagMatches(req.Header.Get("If-None-Match"), c.etag) {
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(c.body)
+	return true
+}
+
+// check if the If-None-Match header lists the ETag, weak or not, or is `*`.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the forwarded request is served through the script cache.
+func (h *PluginHandler) isCachedScriptRequest(req *http.Request, pathAfter string) bool {
+	return h.config.Cache && pathAfter == "script.js" && req.Method == http.MethodGet
+}
+
+// fetch the umami script and prime the script cache.
+// failures are logged, the script is fetched on the first request then.
+func (h *PluginHandler) warmupScriptCache() {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptCacheWarmupTimeout)
+	defer cancel()
+
+	forwardUrl, err := h.getForwardUrl("script.js")
+	if err != nil {
+		h.log(LogLevelWarn, fmt.Sprintf("Could not prefetch the script: %+v", err))
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, forwardUrl, nil)
+	if err != nil {
+		h.log(LogLevelWarn, fmt.Sprintf("Could not prefetch the script: %+v", err))
+		return
+	}
+	req.Header.Set("User-Agent", "traefik-umami-plugin")
+
+	res, err := h.umamiClient().Do(req)
+	if err != nil {
+		h.log(LogLevelWarn, fmt.Sprintf("Could not prefetch the script: %+v", err))
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		h.log(LogLevelWarn, fmt.Sprintf("Could not prefetch the script: status %d", res.StatusCode))
+		return
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		h.log(LogLevelWarn, fmt.Sprintf("Could not prefetch the script: %+v", err))
+		return
+	}
+	if h.isRewrittenScript("script.js", res.StatusCode, res.Header) {
+		body = rewriteScriptUrls(body, &h.config)
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	h.scriptCache.store(res.Header, body)
+	h.checkScriptIntegrity(body)
+}
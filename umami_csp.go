@@ -0,0 +1,74 @@
+package traefik_umami_plugin
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// the directives a script nonce is looked up in, by precedence.
+var cspScriptDirectives = []string{"script-src-elem", "script-src", "default-src"}
+
+// reads the script nonce from the Content-Security-Policy response header.
+// returns an empty string if the policy has no nonce.
+func cspNonce(header http.Header) string {
+	for _, directiveName := range cspScriptDirectives {
+		for _, policy := range header.Values("Content-Security-Policy") {
+			for _, directive := range strings.Split(policy, ";") {
+				fields := strings.Fields(directive)
+				if len(fields) == 0 || !strings.EqualFold(fields[0], directiveName) {
+					continue
+				}
+				for _, source := range fields[1:] {
+					if strings.HasPrefix(source, "'nonce-") && strings.HasSuffix(source, "'") {
+						return strings.TrimSuffix(strings.TrimPrefix(source, "'nonce-"), "'")
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// a random nonce for the injected scripts of a response.
+func generateCSPNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// allows the nonce in the script directive of every Content-Security-Policy of the response.
+// a directive with 'unsafe-inline' is left alone, a nonce would disable it.
+func addCSPNonce(header http.Header, nonce string) {
+	policies := header.Values("Content-Security-Policy")
+	header.Del("Content-Security-Policy")
+	for _, policy := range policies {
+		header.Add("Content-Security-Policy", addPolicyNonce(policy, nonce))
+	}
+}
+
+func addPolicyNonce(policy, nonce string) string {
+	directives := strings.Split(policy, ";")
+	for _, directiveName := range cspScriptDirectives {
+		for i, directive := range directives {
+			fields := strings.Fields(directive)
+			if len(fields) == 0 || !strings.EqualFold(fields[0], directiveName) {
+				continue
+			}
+			for _, source := range fields[1:] {
+				if strings.EqualFold(source, "'unsafe-inline'") {
+					return policy
+				}
+			}
+			directives[i] = strings.Join(append(fields, "'nonce-"+nonce+"'"), " ")
+			if i > 0 {
+				directives[i] = " " + directives[i]
+			}
+			return strings.Join(directives, ";")
+		}
+	}
+	return policy
+}
@@ -1,27 +1,97 @@
 package traefik_umami_plugin
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // check if the requested URL should be forwaeded to umami
 // based on the ForwardPath (eg. /umami)
-// only forwards /api/send and /script.js.
+// only forwards the collect endpoint, eg. /api/send, and /script.js.
 func isUmamiForwardPath(req *http.Request, config *Config) (bool, string) {
+	// an empty forward path disables forwarding
+	if config.ForwardPath == "" {
+		return false, ""
+	}
+	// never forward on excluded hosts, eg. internal or admin hostnames
+	hostname := parseDomainFromHost(req.Host)
+	for _, excludedHost := range config.ForwardExcludeHosts {
+		if strings.EqualFold(excludedHost, hostname) {
+			return false, ""
+		}
+	}
 	currentPath := req.URL.EscapedPath()
-	pathRegex := fmt.Sprintf(`\/%s\/((?:script\.js)|(?:api\/send))`, config.ForwardPath)
+	collectPaths := regexp.QuoteMeta(umamiCollectPath(config))
+	if isEvadingCollectPath(config) {
+		collectPaths += "|" + regexp.QuoteMeta(config.EvadeCollectPath)
+	}
+	pathRegex := fmt.Sprintf(`\/%s\/((?:script\.js)|(?:%s))`, config.ForwardPath, collectPaths)
 	match := regexp.MustCompile(pathRegex).FindStringSubmatch(currentPath)
 	if match != nil {
 		pathAfter := match[1]
+		// the alias is forwarded to the collect endpoint of umami
+		if pathAfter == config.EvadeCollectPath && isEvadingCollectPath(config) {
+			pathAfter = umamiCollectPath(config)
+		}
 		return true, pathAfter
 	}
 	return false, ""
 }
 
+var evadeCollectPathRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9/_.-]*$`)
+
+// check if the collect endpoint is aliased to the evadeCollectPath for the browser.
+// only applies together with evadeGoogleTagManager and forwarding.
+func isEvadingCollectPath(config *Config) bool {
+	return config.EvadeGoogleTagManager && config.EvadeCollectPath != "" && config.ForwardPath != ""
+}
+
+// the path of the collect endpoint the browser sends the events to.
+func browserCollectPath(config *Config) string {
+	if isEvadingCollectPath(config) {
+		return config.EvadeCollectPath
+	}
+	return umamiCollectPath(config)
+}
+
+// check if the forwarded script.js is rewritten, see rewriteScriptUrls.
+func isScriptRewritten(config *Config) bool {
+	return (config.RewriteScriptUrls && config.ForwardPath != "") || isEvadingCollectPath(config)
+}
+
+// check if umami needs the header to attribute the event, eg. the User-Agent.
+func isRequiredForwardHeader(header string) bool {
+	header = strings.ToLower(header)
+	return header == "content-type" || header == "user-agent" || strings.HasPrefix(header, "x-forwarded-")
+}
+
+// removes the stripForwardHeaders from a request to umami, unless they are in the forwardHeaders.
+func stripForwardHeaders(header http.Header, config *Config) {
+	for _, stripped := range config.StripForwardHeaders {
+		isForwarded := false
+		for _, forwarded := range config.ForwardHeaders {
+			if strings.EqualFold(forwarded, stripped) {
+				isForwarded = true
+				break
+			}
+		}
+		if !isForwarded {
+			header.Del(stripped)
+		}
+	}
+}
+
+// the Via entry of the plugin on forwarded requests.
+const forwardViaHeaderValue = "1.1 traefik-umami-plugin"
+
 // build the new URL to umami
 // based on the UmamiHost and pathAfter.
 func (h *PluginHandler) getForwardUrl(pathAfter string) (string, error) {
@@ -37,10 +107,42 @@ func (h *PluginHandler) getForwardUrl(pathAfter string) (string, error) {
 // if not 2XX, shortcut and return forward response
 // if 2XX, continue to next handler.
 func (h *PluginHandler) forwardToUmami(rw http.ResponseWriter, req *http.Request, pathAfter string) {
+	// serve the script from cache
+	cacheable := h.isCachedScriptRequest(req, pathAfter)
+	if cacheable && h.scriptCache.serve(rw, req) {
+		return
+	}
+
+	// limit the events a client can send through the proxy
+	if h.forwardRateLimiter != nil && pathAfter == umamiCollectPath(&h.config) {
+		// all clients without a parsable address would share one limit
+		clientIP, ok := parseRemoteAddrIP(req.RemoteAddr)
+		if !ok {
+			h.log(LogLevelDebug, fmt.Sprintf("Could not parse the client address %q, not rate limiting it", req.RemoteAddr))
+		} else if !h.forwardRateLimiter.allow(clientIP, time.Now()) {
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// reject events for website ids of other websites
+	if h.config.RestrictForwardWebsiteId && pathAfter == umamiCollectPath(&h.config) {
+		allowed, err := h.hasAllowedWebsiteId(req)
+		if err == errEventBodyTooLarge {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !allowed {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
 	// build URL
 	forwardUrl, err := h.getForwardUrl(pathAfter)
 	if err != nil {
-		// h.log(fmt.Sprintf("h.getForwardUrl: %+v", err))
+		h.log(LogLevelDebug, fmt.Sprintf("h.getForwardUrl: %+v", err))
+		h.stats.increment(&h.stats.errors)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -48,29 +150,137 @@ func (h *PluginHandler) forwardToUmami(rw http.ResponseWriter, req *http.Request
 	// build proxy request
 	proxyReq, err := newForwardRequest(req, forwardUrl)
 	if err != nil {
-		// h.log(fmt.Sprintf("traefik_plugin_forward_request.NewForwardRequest: %+v", err))
+		h.log(LogLevelDebug, fmt.Sprintf("traefik_plugin_forward_request.NewForwardRequest: %+v", err))
+		h.stats.increment(&h.stats.errors)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// cookies and credentials of the website are no business of umami
+	stripForwardHeaders(proxyReq.Header, &h.config)
+
+	// identifies the requests of the plugin in the logs of umami
+	if h.config.ForwardViaHeader {
+		proxyReq.Header.Add("Via", forwardViaHeaderValue)
+	}
+
+	// the script is rewritten uncompressed, and cached uncompressed,
+	// as the cached script is served to clients of any Accept-Encoding
+	if cacheable || (isScriptRewritten(&h.config) && pathAfter == "script.js") {
+		proxyReq.Header.Set("Accept-Encoding", "identity")
+	}
+
 	// make proxy request
-	client := &http.Client{}
-	proxyRes, err := client.Do(proxyReq)
+	proxyRes, err := h.umamiClient().Do(proxyReq)
 	if err != nil {
-		// h.log(fmt.Sprintf("h.client.Do: %+v", err))
+		h.log(LogLevelDebug, fmt.Sprintf("h.client.Do: %+v", err))
+		h.stats.increment(&h.stats.errors)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer proxyRes.Body.Close()
 
-	// build response
-	copyHeaders(rw.Header(), proxyRes.Header)
-	removeHeaders(rw.Header(), hopHeaders...)
-	rw.WriteHeader(proxyRes.StatusCode)
+	// read the response before writing it, so errors can still be responded
 	body, err := io.ReadAll(proxyRes.Body)
 	if err != nil {
-		// h.log(fmt.Sprintf("io.ReadAll: %+v", err))
+		h.log(LogLevelDebug, fmt.Sprintf("io.ReadAll: %+v", err))
+		h.stats.increment(&h.stats.errors)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if h.isRewrittenScript(pathAfter, proxyRes.StatusCode, proxyRes.Header) {
+		body = rewriteScriptUrls(body, &h.config)
+		proxyRes.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	// build response
+	copyHeaders(rw.Header(), proxyRes.Header)
+	removeHeaders(rw.Header(), hopHeaders...)
+	rw.WriteHeader(proxyRes.StatusCode)
 	rw.Write(body)
+
+	// cache the script, unless umami compressed it anyway
+	if cacheable && proxyRes.StatusCode == http.StatusOK && proxyRes.Header.Get("Content-Encoding") == "" {
+		h.scriptCache.store(proxyRes.Header, body)
+		h.checkScriptIntegrity(body)
+	}
+}
+
+// check if the absolute umami urls of the forwarded response are rewritten.
+// only applies to an uncompressed script, never to other responses.
+func (h *PluginHandler) isRewrittenScript(pathAfter string, statusCode int, header http.Header) bool {
+	if !isScriptRewritten(&h.config) || pathAfter != "script.js" || statusCode != http.StatusOK {
+		return false
+	}
+	if contentEncoding(header.Get("Content-Encoding")) != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	return contentType == "" || strings.Contains(contentType, "javascript")
+}
+
+// replaces the absolute umami host in the script with the forward path,
+// so requests the script makes are proxied as well.
+// with the evadeCollectPath, the collect endpoint is replaced with the alias.
+// also replaces the JSON escaped forms, eg. `https:\/\/umami.example`.
+func rewriteScriptUrls(body []byte, config *Config) []byte {
+	umamiHost := strings.TrimSuffix(config.UmamiHost, "/")
+	if config.RewriteScriptUrls && umamiHost != "" {
+		body = replaceScriptUrl(body, umamiHost, scriptHostUrl(config))
+	}
+	if isEvadingCollectPath(config) {
+		body = replaceScriptUrl(body, "/"+umamiCollectPath(config), "/"+config.EvadeCollectPath)
+	}
+	return body
+}
+
+// replaces the url in its plain and JSON escaped form.
+func replaceScriptUrl(body []byte, url, replacement string) []byte {
+	escapedUrl := strings.ReplaceAll(url, "/", `\/`)
+	escapedReplacement := strings.ReplaceAll(replacement, "/", `\/`)
+	body = bytes.ReplaceAll(body, []byte(url), []byte(replacement))
+	return bytes.ReplaceAll(body, []byte(escapedUrl), []byte(escapedReplacement))
+}
+
+// the website ids events may be forwarded for.
+func allowedWebsiteIds(config *Config) map[string]bool {
+	websiteIds := map[string]bool{config.WebsiteId: true}
+	for _, websiteId := range config.WebsiteIds {
+		websiteIds[websiteId] = true
+	}
+	for _, websiteId := range config.WebsiteIdBySNI {
+		websiteIds[websiteId] = true
+	}
+	for _, websiteId := range config.WebsiteIdMap {
+		websiteIds[websiteId] = true
+	}
+	return websiteIds
+}
+
+// the largest event body read to check the website id, an event is a few KiB.
+const maxEventBodyBytes = 64 << 10
+
+var errEventBodyTooLarge = fmt.Errorf("the event body exceeds %d bytes", maxEventBodyBytes)
+
+// check if the forwarded event is for an allowed website id.
+// peeks the JSON body, the request body stays readable for forwarding.
+// returns errEventBodyTooLarge for bodies over maxEventBodyBytes, which are not read to the end.
+func (h *PluginHandler) hasAllowedWebsiteId(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxEventBodyBytes+1))
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false, nil
+	}
+	if len(body) > maxEventBodyBytes {
+		return false, errEventBodyTooLarge
+	}
+	var sendBody SendBody
+	if err := json.Unmarshal(body, &sendBody); err != nil {
+		return false, nil
+	}
+	return h.allowedWebsiteIds[sendBody.Payload.Website], nil
 }
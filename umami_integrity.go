@@ -0,0 +1,78 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// scriptIntegrity value to compute the hash from the script of the umamiHost.
+const scriptIntegrityAuto = "auto"
+
+// timeout for fetching the script to compute its integrity in New.
+const scriptIntegrityTimeout = 5 * time.Second
+
+// check if the value is a subresource integrity hash, eg. `sha384-...`.
+func isIntegrityHash(value string) bool {
+	for _, algorithm := range []string{"sha256-", "sha384-", "sha512-"} {
+		if strings.HasPrefix(value, algorithm) && len(value) > len(algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// the sha384 subresource integrity hash of the script.
+func scriptIntegrityHash(script []byte) string {
+	sum := sha512.Sum384(script)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// fetches the script as the browser receives it through the forward path
+// and computes its integrity hash.
+func fetchScriptIntegrity(config *Config, client *http.Client) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptIntegrityTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/script.js", config.UmamiHost)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "traefik-umami-plugin")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	// the forwarded script is rewritten before it is served
+	if isScriptRewritten(config) {
+		body = rewriteScriptUrls(body, config)
+	}
+	return scriptIntegrityHash(body), nil
+}
+
+// warns if the script served under the forward path doesn't match the integrity of the tag,
+// eg. after an upgrade of umami, browsers then refuse to run the tracker.
+func (h *PluginHandler) checkScriptIntegrity(script []byte) {
+	if h.config.ScriptIntegrity == "" || h.config.ScriptIntegrity == scriptIntegrityAuto {
+		return
+	}
+	if integrity := scriptIntegrityHash(script); !strings.HasPrefix(h.config.ScriptIntegrity, "sha384-") || integrity == h.config.ScriptIntegrity {
+		return
+	}
+	h.log(LogLevelWarn, "The script of Umami changed and doesn't match the scriptIntegrity anymore, browsers block it until the plugin is restarted or the hash is updated!")
+}
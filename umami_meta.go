@@ -0,0 +1,44 @@
+package traefik_umami_plugin
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// limits how many meta properties are added to the event data of a page.
+const maxMetaProperties = 50
+
+var metaTagRegex = regexp.MustCompile(`(?i)<meta\s[^>]*>`)
+var metaAttributeRegex = regexp.MustCompile(`(?i)\s(name|property|content)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// the content of the meta tags whose name starts with the prefix, keyed by the rest of the name,
+// eg. `<meta name="umami:plan" content="pro">` is `plan: pro` for the prefix `umami:`.
+func readMetaProperties(body []byte, prefix string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, tag := range metaTagRegex.FindAll(body, -1) {
+		var name, content string
+		var hasContent bool
+		for _, attribute := range metaAttributeRegex.FindAllSubmatch(tag, -1) {
+			value := string(attribute[2]) + string(attribute[3]) + string(attribute[4])
+			switch strings.ToLower(string(attribute[1])) {
+			case "content":
+				content, hasContent = html.UnescapeString(value), true
+			default:
+				name = html.UnescapeString(value)
+			}
+		}
+		if !hasContent || len(name) <= len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+			continue
+		}
+		key := name[len(prefix):]
+		if _, ok := properties[key]; ok {
+			continue
+		}
+		properties[key] = content
+		if len(properties) >= maxMetaProperties {
+			break
+		}
+	}
+	return properties
+}
@@ -0,0 +1,52 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+)
+
+// injects into the parts of a multipart body with one of the content types.
+// returns the body unmodified if it can't be parsed.
+func injectMultipart(body []byte, contentType string, contentTypes []string, inject func([]byte) []byte) []byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return body
+	}
+
+	var result bytes.Buffer
+	writer := multipart.NewWriter(&result)
+	if err := writer.SetBoundary(params["boundary"]); err != nil {
+		return body
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	modified := false
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body
+		}
+		partBody, err := io.ReadAll(part)
+		if err != nil {
+			return body
+		}
+		if isInjectableContentType(part.Header.Get("Content-Type"), contentTypes) {
+			injected := inject(partBody)
+			modified = modified || !bytes.Equal(injected, partBody)
+			partBody = injected
+		}
+		partWriter, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return body
+		}
+		partWriter.Write(partBody)
+	}
+	if err := writer.Close(); err != nil || !modified {
+		return body
+	}
+	return result.Bytes()
+}
@@ -0,0 +1,104 @@
+package traefik_umami_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// the opt-out cookie is kept for the maximum lifetime browsers allow.
+const optOutCookieMaxAge = 400 * 24 * 60 * 60
+
+// the form is posted, so another website can't opt the visitor out with a link or an image.
+const optOutFormHtml = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Analytics opt-out</title></head>
+<body><form method="post"><p>Opt out of analytics on this website?</p><button type="submit">Opt out</button></form></body>
+</html>
+`
+
+const optOutPageHtml = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Analytics opt-out</title></head>
+<body><p>You have opted out of analytics on this website.</p></body>
+</html>
+`
+
+// check if the request is for the opt-out page.
+func isOptOutPath(req *http.Request, config *Config) bool {
+	return config.OptOutPath != "" && req.URL.Path == config.OptOutPath
+}
+
+// check if the visitor opted out of tracking.
+// with doNotTrack, a `DNT: 1` header or the opt-out cookie opts out,
+// even without an opt-out page.
+func isOptedOut(req *http.Request, config *Config) bool {
+	if config.DoNotTrack && req.Header.Get("DNT") == "1" {
+		return true
+	}
+	if (config.OptOutPath == "" && !config.DoNotTrack) || config.OptOutCookieName == "" {
+		return false
+	}
+	_, err := req.Cookie(config.OptOutCookieName)
+	return err == nil
+}
+
+// serve the opt-out form, and set the opt-out cookie once it is posted.
+func (h *PluginHandler) serveOptOut(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		page := optOutFormHtml
+		if isOptedOut(req, &h.config) {
+			page = optOutPageHtml
+		}
+		serveOptOutPage(rw, req, page)
+		return
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if isCrossSiteRequest(req) {
+		h.log(LogLevelDebug, "Rejected an opt-out posted by another website")
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     h.config.OptOutCookieName,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   optOutCookieMaxAge,
+		HttpOnly: true,
+		Secure:   forwardedScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	serveOptOutPage(rw, req, optOutPageHtml)
+}
+
+func serveOptOutPage(rw http.ResponseWriter, req *http.Request, page string) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(page)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		rw.Write([]byte(page))
+	}
+}
+
+// check if the request was sent by another website, eg. a form it submitted.
+// browsers sending neither Sec-Fetch-Site nor Origin are trusted.
+func isCrossSiteRequest(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil || origin == "null" {
+		return true
+	}
+	return !strings.EqualFold(originUrl.Host, forwardedHost(req))
+}
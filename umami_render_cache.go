@@ -0,0 +1,64 @@
+package traefik_umami_plugin
+
+import (
+	"container/list"
+	"sync"
+)
+
+// renderedScriptCache is a bounded LRU cache of scripts rendered per request,
+// eg. per website id of websiteIdMap, so only the active ones are kept.
+type renderedScriptCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is the most recently used
+	entries map[renderedScriptKey]*list.Element
+}
+
+type renderedScriptKey struct {
+	websiteId    string
+	routePattern string
+	xhtml        bool
+}
+
+type renderedScriptEntry struct {
+	key  renderedScriptKey
+	html string
+}
+
+func newRenderedScriptCache(size int) *renderedScriptCache {
+	return &renderedScriptCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[renderedScriptKey]*list.Element{},
+	}
+}
+
+// returns the cached script, or renders and caches it.
+// the least recently used script is evicted beyond the size.
+func (c *renderedScriptCache) get(key renderedScriptKey, render func() string) string {
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		html := element.Value.(*renderedScriptEntry).html
+		c.mu.Unlock()
+		return html
+	}
+	c.mu.Unlock()
+
+	// render outside the lock, a concurrent render of the same key is harmless
+	html := render()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return html
+	}
+	c.entries[key] = c.order.PushFront(&renderedScriptEntry{key: key, html: html})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderedScriptEntry).key)
+	}
+	return html
+}
@@ -1,124 +1,635 @@
 package traefik_umami_plugin
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 const insertBeforeRegexPattern = `</body>`
 
 var insertBeforeRegex = regexp.MustCompile(insertBeforeRegexPattern)
 
-// injects the umami script into the response head.
-func regexReplaceSingle(bytes []byte, match *regexp.Regexp, replace string) []byte {
-	rx := match.FindIndex(bytes)
-	if len(rx) == 0 {
-		return bytes
+// where the script is inserted into the page.
+type injectionAnchor struct {
+	regex *regexp.Regexp
+	after bool // inserts after the match instead of before it
+	group int  // inserts at the start of this capture group instead, if it is > 0
+}
+
+// the name of the capture group of the scriptInjectionRegex to insert at.
+const injectionGroupName = "inject"
+
+// the index of the match to insert at.
+// an unmatched capture group is -1, which is never a tag boundary.
+func (a injectionAnchor) index(match []int) int {
+	if a.group > 0 {
+		return match[2*a.group]
+	}
+	if a.after {
+		return match[1]
+	}
+	return match[0]
+}
+
+// the named values of scriptInjectionTarget, any other value is a regex.
+var injectionTargets = map[string]injectionAnchor{
+	SITargetHeadStart: {regex: regexp.MustCompile(`(?i)<head(?:\s[^>]*)?>`), after: true},
+	SITargetHeadEnd:   {regex: regexp.MustCompile(`(?i)</head>`)},
+	SITargetBodyEnd:   {regex: insertBeforeRegex},
+}
+
+// parses the scriptInjectionTarget.
+func parseInjectionTarget(target string) (injectionAnchor, error) {
+	if anchor, ok := injectionTargets[target]; ok {
+		return anchor, nil
+	}
+	if target == "" {
+		return injectionAnchor{}, fmt.Errorf("empty target")
+	}
+	regex, err := regexp.Compile(target)
+	if err != nil {
+		return injectionAnchor{}, err
+	}
+	return injectionAnchor{regex: regex}, nil
+}
+
+// parses the scriptInjectionRegex, the script is inserted after its match,
+// or at the start of the `inject` capture group, eg. `<!-- analytics -->(?P<inject>)`.
+func parseInjectionRegex(pattern string) (injectionAnchor, error) {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return injectionAnchor{}, err
+	}
+	return injectionAnchor{regex: regex, after: true, group: regex.SubexpIndex(injectionGroupName)}, nil
+}
+
+// injects the umami script into the response.
+// only inserts at the first match that is at a tag boundary.
+func regexReplaceSingle(bytes []byte, anchor injectionAnchor, replace string) []byte {
+	for _, rx := range anchor.regex.FindAllSubmatchIndex(bytes, -1) {
+		if isTagBoundary(bytes, anchor.index(rx)) {
+			return insertAt(bytes, anchor.index(rx), replace)
+		}
+	}
+	return bytes
+}
+
+// like regexReplaceSingle, but inserts at the last match.
+func regexReplaceLast(bytes []byte, anchor injectionAnchor, replace string) []byte {
+	matches := anchor.regex.FindAllSubmatchIndex(bytes, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if isTagBoundary(bytes, anchor.index(matches[i])) {
+			return insertAt(bytes, anchor.index(matches[i]), replace)
+		}
+	}
+	return bytes
+}
+
+// inserts the string at the index into a copy of bytes.
+func insertAt(bytes []byte, index int, insert string) []byte {
+	result := make([]byte, 0, len(bytes)+len(insert))
+	result = append(result, bytes[:index]...)
+	result = append(result, insert...)
+	return append(result, bytes[index:]...)
+}
+
+// check if the index is a safe position to insert html.
+// it must be the start of a tag or directly follow the end of a tag,
+// and never split a multibyte rune.
+func isTagBoundary(bytes []byte, index int) bool {
+	if index < 0 || index > len(bytes) {
+		return false
+	}
+	if index < len(bytes) && !utf8.RuneStart(bytes[index]) {
+		return false
+	}
+	return (index < len(bytes) && bytes[index] == '<') || (index > 0 && bytes[index-1] == '>')
+}
+
+var scriptOpenRegex = regexp.MustCompile(`(?i)<script[\s>]`)
+var scriptCloseRegex = regexp.MustCompile(`(?i)</script\s*>`)
+
+// the index behind the element the index is in.
+// a match inside a tag, eg. in the src of a script, ends behind the tag,
+// and a match inside a script ends behind its closing tag.
+// returns -1 if the element is not closed.
+func afterElementIndex(html []byte, index int) int {
+	if bytes.LastIndexByte(html[:index], '<') > bytes.LastIndexByte(html[:index], '>') {
+		end := bytes.IndexByte(html[index:], '>')
+		if end < 0 {
+			return -1
+		}
+		index += end + 1
+	}
+	opened := len(scriptOpenRegex.FindAllIndex(html[:index], -1))
+	closed := len(scriptCloseRegex.FindAllIndex(html[:index], -1))
+	if opened > closed {
+		loc := scriptCloseRegex.FindIndex(html[index:])
+		if loc == nil {
+			return -1
+		}
+		index += loc[1]
+	}
+	return index
+}
+
+// a lightweight well-formedness check of the injected html.
+// the script tags must still be balanced and the anchor must still be present,
+// if they were in the original html.
+func isValidInjection(orig, injected []byte, anchor *regexp.Regexp) bool {
+	countScripts := func(html []byte) (int, int) {
+		return len(scriptOpenRegex.FindAllIndex(html, -1)), len(scriptCloseRegex.FindAllIndex(html, -1))
 	}
-	// insert the script before the head tag
-	return append(bytes[:rx[0]], append([]byte(replace), bytes[rx[0]:]...)...)
+	if origOpened, origClosed := countScripts(orig); origOpened == origClosed {
+		if opened, closed := countScripts(injected); opened != closed {
+			return false
+		}
+	}
+	return !anchor.Match(orig) || anchor.Match(injected)
+}
+
+// the url the browser loads the script from and sends the events to.
+// this is the scriptHostOverride if set, the forward path,
+// or the scriptHostUrl if forwarding is disabled.
+func scriptHostUrl(config *Config) string {
+	if config.ScriptHostOverride != "" {
+		return strings.TrimSuffix(config.ScriptHostOverride, "/")
+	}
+	if config.ForwardPath == "" {
+		return strings.TrimSuffix(config.ScriptHostUrl, "/")
+	}
+	return "/" + config.ForwardPath
+}
+
+// per request values rendered into the umami script.
+type scriptParams struct {
+	websiteId    string
+	routePattern string
+	nonce        string
+	origin       string // of the page as the client requested it, eg. `https://example.com`
+	xhtml        bool   // the page is XHTML, parsed as XML by the browser
+}
+
+// the script params of a request without any per request values.
+func defaultScriptParams(config *Config) scriptParams {
+	return scriptParams{
+		websiteId: config.WebsiteId,
+	}
+}
+
+// a stable key of the script version for CDN purging.
+func scriptSurrogateKey(scriptHtml string) string {
+	sum := sha256.Sum256([]byte(scriptHtml))
+	return "umami-" + hex.EncodeToString(sum[:8])
 }
 
-// builds the umami script.
-func buildUmamiScript(config *Config) (string, error) {
+// downloads the script source if it is needed for the injection.
+func fetchUmamiScriptSource(config *Config, client *http.Client) (string, error) {
 	// check if the script should be injected
-	if config.ScriptInjection == false {
+	if config.ScriptInjection == false || config.ScriptInjectionMode != SIModeSource {
 		return "", nil
 	}
+	scriptJs, err := downloadScript(config, context.Background(), client)
+	if err != nil {
+		return "", err
+	}
+	// the inlined script sends its events to the alias as well
+	if isEvadingCollectPath(config) {
+		scriptJs = string(replaceScriptUrl([]byte(scriptJs), "/"+umamiCollectPath(config), "/"+config.EvadeCollectPath))
+	}
+	return scriptJs, nil
+}
 
-	// download the script
-	var scriptJs string
-	if config.ScriptInjectionMode == SIModeSource {
-		_scriptJs, err := downloadScript(config, context.Background())
-		if err != nil {
-			return "", err
-		}
-		scriptJs = _scriptJs
+// renders the umami script html.
+func renderUmamiScript(config *Config, scriptJs string, params scriptParams) string {
+	// check if the script should be injected
+	if config.ScriptInjection == false {
+		return ""
 	}
 
 	// src url
 	var src string
 	if config.ScriptInjectionMode == SIModeTag {
-		src = fmt.Sprintf(`/%s/script.js`, config.ForwardPath)
+		src = fmt.Sprintf(`%s/script.js`, scriptHostUrl(config))
 	}
 
-	if config.EvadeGoogleTagManager {
-		return buildUmamiScriptWithEvade(config, scriptJs, src), nil
-	} else {
-		return buildUmamiScriptWithoutEvade(config, scriptJs, src), nil
+	// one tracker per co-tracked website id
+	var html string
+	for _, websiteId := range trackedWebsiteIds(config, params.websiteId) {
+		trackerParams := params
+		trackerParams.websiteId = websiteId
+		// the idle strategy needs the loader snippet of the evade script
+		if config.EvadeGoogleTagManager || config.ScriptLoadStrategy == SLStrategyIdle {
+			html += buildUmamiScriptWithEvade(config, scriptJs, src, trackerParams)
+		} else {
+			html += buildUmamiScriptWithoutEvade(config, scriptJs, src, trackerParams)
+		}
+	}
+	return html + buildHelperScripts(config, params)
+}
+
+// the website id of the request followed by the co-tracked websiteIds.
+func trackedWebsiteIds(config *Config, websiteId string) []string {
+	websiteIds := []string{websiteId}
+	for _, coTrackedId := range config.WebsiteIds {
+		isDuplicate := false
+		for _, trackedId := range websiteIds {
+			if trackedId == coTrackedId {
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate && coTrackedId != "" {
+			websiteIds = append(websiteIds, coTrackedId)
+		}
+	}
+	return websiteIds
+}
+
+// renders the inline helper scripts enabled in the config.
+func buildHelperScripts(config *Config, params scriptParams) string {
+	var js string
+	if config.TrackDownloads {
+		js += buildDownloadTrackingJs(config)
+	}
+	if config.UseBeacon {
+		js += buildBeaconJs(config)
+	}
+	if config.Heartbeat {
+		js += buildHeartbeatJs(config)
+	}
+	if js == "" {
+		return ""
+	}
+
+	html := "<script"
+	if params.nonce != "" {
+		html += fmt.Sprintf(" nonce='%s'", template.HTMLEscapeString(params.nonce))
+	}
+	html += ">"
+	html += inlineScriptJs(js, params)
+	html += "</script>"
+	return html
+}
+
+// boolean attributes are minimized in html, XML requires a value.
+func booleanAttribute(name string, params scriptParams) string {
+	if params.xhtml {
+		return fmt.Sprintf(" %s='%s'", name, name)
+	}
+	return " " + name
+}
+
+// the js of an inline script, in a CDATA section for XHTML pages,
+// so an XML parser accepts its `<` and `&`.
+func inlineScriptJs(js string, params scriptParams) string {
+	if !params.xhtml {
+		return js
+	}
+	// a `]]>` in the js would end the section early
+	js = strings.ReplaceAll(js, "]]>", "]]]]><![CDATA[>")
+	return "//<![CDATA[\n" + js + "\n//]]>"
+}
+
+// tracks clicks on links to files with the download extensions as `download` event.
+func buildDownloadTrackingJs(config *Config) string {
+	extensions := []string{}
+	for _, extension := range config.DownloadExtensions {
+		extension = strings.ToLower(extension)
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions = append(extensions, extension)
+	}
+	// json.Marshal escapes <, > and &, so the list can't close the script tag
+	extensionsJson, _ := json.Marshal(extensions)
+
+	js := "(function () {"
+	js += fmt.Sprintf("var extensions = %s;", extensionsJson)
+	js += "document.addEventListener('click', function (e) {"
+	js += "var a = e.target.closest && e.target.closest('a[href]');"
+	js += "if (!a || !window.umami) return;"
+	js += "var path = a.pathname.toLowerCase();"
+	js += "for (var i = 0; i < extensions.length; i++) {"
+	js += "if (path.slice(-extensions[i].length) === extensions[i]) {"
+	js += fmt.Sprintf("umami.track('%s', { file: a.href });", template.JSEscapeString(prefixedEventName(config, "download")))
+	js += "return;"
+	js += "}"
+	js += "}"
+	js += "}, true);"
+	js += "})();"
+	return js
+}
+
+// tracks a `heartbeat` event every heartbeatInterval while the page is visible,
+// so the time spent on a page can be told from the last heartbeat.
+func buildHeartbeatJs(config *Config) string {
+	interval, err := time.ParseDuration(config.HeartbeatInterval)
+	if err != nil {
+		return ""
 	}
+
+	js := "(function () {"
+	js += "var timer = null;"
+	js += fmt.Sprintf("var beat = function () { if (window.umami) umami.track('%s'); };", template.JSEscapeString(prefixedEventName(config, "heartbeat")))
+	js += "var update = function () {"
+	js += "if (document.visibilityState === 'visible') {"
+	js += fmt.Sprintf("if (timer === null) timer = setInterval(beat, %d);", interval.Milliseconds())
+	js += "} else if (timer !== null) {"
+	js += "clearInterval(timer);"
+	js += "timer = null;"
+	js += "}"
+	js += "};"
+	js += "document.addEventListener('visibilitychange', update);"
+	js += "update();"
+	js += "})();"
+	return js
+}
+
+// sends the events of the tracker with navigator.sendBeacon once the page is hidden,
+// so the last events are not lost when the visitor navigates away.
+func buildBeaconJs(config *Config) string {
+	// json.Marshal escapes <, > and &, so the url can't close the script tag
+	endpointJson, _ := json.Marshal(scriptHostUrl(config) + "/" + browserCollectPath(config))
+
+	js := "(function () {"
+	js += "if (!navigator.sendBeacon || !window.fetch) return;"
+	js += fmt.Sprintf("var endpoint = %s;", endpointJson)
+	js += "var hidden = false;"
+	js += "addEventListener('pagehide', function () { hidden = true; });"
+	js += "addEventListener('pageshow', function () { hidden = false; });"
+	js += "document.addEventListener('visibilitychange', function () { hidden = document.visibilityState === 'hidden'; });"
+	js += "var fetch = window.fetch;"
+	js += "window.fetch = function (input, init) {"
+	js += "var url = typeof input === 'string' ? input : input && input.url;"
+	js += "if (hidden && url && url.indexOf(endpoint) !== -1 && init && typeof init.body === 'string'"
+	js += " && navigator.sendBeacon(url, new Blob([init.body], { type: 'application/json' }))) {"
+	js += "return Promise.resolve(new Response(null, { status: 204 }));"
+	js += "}"
+	js += "return fetch.apply(this, arguments);"
+	js += "};"
+	js += "})();"
+	return js
 }
 
-func buildUmamiScriptWithEvade(config *Config, scriptJs, src string) string {
-	html := "<script>"
-	html += "(function () {"
-	html += "var el = document.createElement('script');"
-	html += fmt.Sprintf("el.setAttribute('data-host-url', '%s');", config.ForwardPath)
+func buildUmamiScriptWithEvade(config *Config, scriptJs, src string, params scriptParams) string {
+	setAttribute := evadeSetAttribute
+	if config.EvadeGoogleTagManager && config.EvadeObfuscate {
+		setAttribute = evadeSetAttributeObfuscated
+	}
+
+	html := "<script"
+	if params.nonce != "" {
+		html += fmt.Sprintf(" nonce='%s'", template.HTMLEscapeString(params.nonce))
+	}
+	html += ">"
+	js := "(function () {"
+	if config.EvadeGoogleTagManager && config.EvadeObfuscate {
+		js += "var d = function (s) { return atob(s); };"
+	}
+	js += "var el = document.createElement('script');"
+	if params.nonce != "" {
+		js += fmt.Sprintf("el.nonce = '%s';", template.JSEscapeString(params.nonce))
+	}
+	// set first, so the attributes of the plugin take precedence
+	for _, attribute := range appendScriptAttributes(nil, config) {
+		js += setAttribute(attribute[0], attribute[1])
+	}
+	js += setAttribute("data-host-url", scriptHostUrl(config))
 	if config.ScriptInjectionMode == SIModeTag {
-		html += fmt.Sprintf("el.setAttribute('src', '%s');", src)
+		js += setAttribute("src", src)
+		if config.ScriptFetchPriority != "" {
+			js += setAttribute("fetchpriority", config.ScriptFetchPriority)
+		}
+		if config.ScriptIntegrity != "" {
+			js += setAttribute("integrity", config.ScriptIntegrity)
+			js += setAttribute("crossorigin", "anonymous")
+		}
 	} else if config.ScriptInjectionMode == SIModeSource {
 		scriptBase64 := base64.StdEncoding.EncodeToString([]byte(scriptJs))
-		html += "el.setAttribute('type', 'text/javascript');"
-		html += fmt.Sprintf("el.innerHTML = atob('%s');", scriptBase64)
+		js += "el.setAttribute('type', 'text/javascript');"
+		js += fmt.Sprintf("el.innerHTML = atob('%s');", scriptBase64)
 	}
-	html += fmt.Sprintf("el.setAttribute('data-website-id', '%s');", config.WebsiteId)
-	if config.AutoTrack {
-		html += "el.setAttribute('data-auto-track', 'true');"
+	js += setAttribute("data-website-id", params.websiteId)
+	if isAutoTrackedWithDefaultEvent(config) {
+		js += setAttribute("data-auto-track", "true")
 	} else {
-		html += "el.setAttribute('data-auto-track', 'false');"
+		js += setAttribute("data-auto-track", "false")
 	}
 	if config.DoNotTrack {
-		html += "el.setAttribute('data-do-not-track', 'true');"
+		js += setAttribute("data-do-not-track", "true")
 	}
 	if config.Cache {
-		html += "el.setAttribute('data-cache', 'true');"
+		js += setAttribute("data-cache", "true")
 	}
 	if len(config.Domains) > 0 {
-		html += fmt.Sprintf("el.setAttribute('data-domains', '%s');", strings.Join(config.Domains, ","))
+		js += setAttribute("data-domains", strings.Join(config.Domains, ","))
+	}
+	if params.routePattern != "" {
+		js += setAttribute("data-route-pattern", params.routePattern)
+	}
+	if config.EventNamePrefix != "" {
+		js += setAttribute("data-tag", config.EventNamePrefix)
+	}
+	trackJs := autoTrackEventJs(config)
+	if trackJs != "" && config.ScriptInjectionMode == SIModeTag {
+		js += fmt.Sprintf("el.onload = function () { %s };", trackJs)
+	}
+	// the body does not exist yet if the script is injected into the head
+	loadJs := "(document.body || document.head).appendChild(el);"
+	if trackJs != "" && config.ScriptInjectionMode == SIModeSource {
+		loadJs += trackJs
 	}
-	html += "document.body.appendChild(el);"
-	html += "})();"
+	if config.ScriptLoadStrategy == SLStrategyIdle {
+		// load the tracker once the browser is idle, setTimeout if requestIdleCallback is not supported
+		js += fmt.Sprintf("var load = function () { %s };", loadJs)
+		js += "if (window.requestIdleCallback) { window.requestIdleCallback(load); } else { setTimeout(load, 1); }"
+	} else {
+		js += loadJs
+	}
+	js += "})();"
+	html += inlineScriptJs(js, params)
 	html += "</script>"
 	return html
 }
 
-func buildUmamiScriptWithoutEvade(config *Config, scriptJs, src string) string {
+// renders a plain setAttribute call for the evade snippet.
+func evadeSetAttribute(name, value string) string {
+	return fmt.Sprintf("el.setAttribute('%s', '%s');", name, template.JSEscapeString(value))
+}
+
+// renders a setAttribute call with base64 encoded name and value,
+// decoded at runtime by the `d` helper of the evade snippet.
+func evadeSetAttributeObfuscated(name, value string) string {
+	return fmt.Sprintf("el.setAttribute(d('%s'), d('%s'));",
+		base64.StdEncoding.EncodeToString([]byte(name)),
+		base64.StdEncoding.EncodeToString([]byte(value)))
+}
+
+func buildUmamiScriptWithoutEvade(config *Config, scriptJs, src string, params scriptParams) string {
+	dataAttributes := [][2]string{{"data-host-url", scriptHostUrl(config)}}
 	html := "<script"
-	html += " async"
-	html += " defer"
-	html += fmt.Sprintf(" data-host-url='/%s'", config.ForwardPath)
+	// with the adapter, the tracker must run after it, which only defer guarantees
+	if !config.ObfuscateDataAttributes {
+		html += booleanAttribute("async", params)
+	}
+	html += booleanAttribute("defer", params)
 	if config.ScriptInjectionMode == SIModeTag {
-		html += fmt.Sprintf(" src='%s'", src)
+		html += fmt.Sprintf(" src='%s'", template.HTMLEscapeString(src))
+		if config.ScriptFetchPriority != "" {
+			html += fmt.Sprintf(" fetchpriority='%s'", config.ScriptFetchPriority)
+		}
+		if config.ScriptIntegrity != "" {
+			html += fmt.Sprintf(" integrity='%s' crossorigin='anonymous'", template.HTMLEscapeString(config.ScriptIntegrity))
+		}
+	}
+	if params.nonce != "" {
+		html += fmt.Sprintf(" nonce='%s'", template.HTMLEscapeString(params.nonce))
 	}
-	html += fmt.Sprintf(" data-website-id='%s'", config.WebsiteId)
-	if config.AutoTrack {
-		html += " data-auto-track='true'"
+	dataAttributes = append(dataAttributes, [2]string{"data-website-id", params.websiteId})
+	if isAutoTrackedWithDefaultEvent(config) {
+		dataAttributes = append(dataAttributes, [2]string{"data-auto-track", "true"})
 	} else {
-		html += " data-auto-track='false'"
+		dataAttributes = append(dataAttributes, [2]string{"data-auto-track", "false"})
 	}
 	if config.DoNotTrack {
-		html += " data-do-not-track='true'"
+		dataAttributes = append(dataAttributes, [2]string{"data-do-not-track", "true"})
 	}
 	if config.Cache {
-		html += " data-cache='true'"
+		dataAttributes = append(dataAttributes, [2]string{"data-cache", "true"})
 	}
 	if len(config.Domains) > 0 {
-		html += fmt.Sprintf(" data-domains='%s'", strings.Join(config.Domains, ","))
+		dataAttributes = append(dataAttributes, [2]string{"data-domains", strings.Join(config.Domains, ",")})
+	}
+	if params.routePattern != "" {
+		dataAttributes = append(dataAttributes, [2]string{"data-route-pattern", params.routePattern})
+	}
+	if config.EventNamePrefix != "" {
+		dataAttributes = append(dataAttributes, [2]string{"data-tag", config.EventNamePrefix})
+	}
+	dataAttributes = appendScriptAttributes(dataAttributes, config)
+	if config.ObfuscateDataAttributes {
+		html += fmt.Sprintf(" %s='%s'", obfuscatedDataAttribute, obfuscateDataAttributes(dataAttributes))
+	} else {
+		for _, attribute := range dataAttributes {
+			html += fmt.Sprintf(" %s='%s'", attribute[0], template.HTMLEscapeString(attribute[1]))
+		}
+	}
+	trackJs := autoTrackEventJs(config)
+	if trackJs != "" && config.ScriptInjectionMode == SIModeTag {
+		html += fmt.Sprintf(" onload='%s'", template.HTMLEscapeString(trackJs))
 	}
 	html += ">"
 	if config.ScriptInjectionMode == SIModeSource {
-		html += scriptJs
+		js := scriptJs
+		if trackJs != "" {
+			js += ";" + trackJs
+		}
+		html += inlineScriptJs(js, params)
+	}
+	html += "</script>"
+	if config.ObfuscateDataAttributes {
+		html += buildDataAttributesAdapter(params)
+	}
+	return html
+}
+
+var scriptAttributeKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*$`)
+
+// appends the scriptAttributes as `data-<key>` sorted by key.
+// attributes the plugin already sets, eg. `data-website-id`, are not overridden.
+func appendScriptAttributes(dataAttributes [][2]string, config *Config) [][2]string {
+	keys := make([]string, 0, len(config.ScriptAttributes))
+	for key := range config.ScriptAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := "data-" + strings.TrimPrefix(strings.ToLower(key), "data-")
+		isDuplicate := false
+		for _, attribute := range dataAttributes {
+			if attribute[0] == name {
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate && scriptAttributeKeyRegex.MatchString(strings.TrimPrefix(name, "data-")) {
+			dataAttributes = append(dataAttributes, [2]string{name, config.ScriptAttributes[key]})
+		}
+	}
+	return dataAttributes
+}
+
+// the neutral attribute holding the obfuscated data attributes.
+const obfuscatedDataAttribute = "data-cfg"
+
+// encodes the data attributes as base64 json object, eg. `{"data-website-id":"..."}`.
+func obfuscateDataAttributes(dataAttributes [][2]string) string {
+	js := "{"
+	for i, attribute := range dataAttributes {
+		if i > 0 {
+			js += ","
+		}
+		name, _ := json.Marshal(attribute[0])
+		value, _ := json.Marshal(attribute[1])
+		js += fmt.Sprintf("%s:%s", name, value)
+	}
+	js += "}"
+	return base64.StdEncoding.EncodeToString([]byte(js))
+}
+
+// the inline script setting the obfuscated data attributes on the tracker tag in front of it.
+// it runs while the page is parsed, before the deferred tracker reads its attributes.
+func buildDataAttributesAdapter(params scriptParams) string {
+	html := "<script"
+	if params.nonce != "" {
+		html += fmt.Sprintf(" nonce='%s'", template.HTMLEscapeString(params.nonce))
 	}
+	html += ">"
+	js := "(function (el) {"
+	js += "if (!el) return;"
+	js += fmt.Sprintf("var attributes = JSON.parse(atob(el.getAttribute('%s')));", obfuscatedDataAttribute)
+	js += "for (var name in attributes) el.setAttribute(name, attributes[name]);"
+	js += fmt.Sprintf("el.removeAttribute('%s');", obfuscatedDataAttribute)
+	js += "})(document.currentScript && document.currentScript.previousElementSibling);"
+	html += inlineScriptJs(js, params)
 	html += "</script>"
 	return html
 }
 
-func downloadScript(config *Config, ctx context.Context) (string, error) {
+// check if umami itself tracks the page views.
+// with an autoTrackEventName, the page view is tracked by the plugin snippet instead.
+func isAutoTrackedWithDefaultEvent(config *Config) bool {
+	return config.AutoTrack && config.AutoTrackEventName == ""
+}
+
+// the js tracking the page view as named event, once the tracker is loaded.
+func autoTrackEventJs(config *Config) string {
+	if !config.AutoTrack || config.AutoTrackEventName == "" {
+		return ""
+	}
+	return fmt.Sprintf("umami.track('%s');", template.JSEscapeString(prefixedEventName(config, config.AutoTrackEventName)))
+}
+
+// prepends the eventNamePrefix to the event name, eg. `staging:download`.
+func prefixedEventName(config *Config, name string) string {
+	return config.EventNamePrefix + name
+}
+
+func downloadScript(config *Config, ctx context.Context, client *http.Client) (string, error) {
 	// request
 	url := fmt.Sprintf("%s/script.js", config.UmamiHost)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -130,11 +641,15 @@ func downloadScript(config *Config, ctx context.Context) (string, error) {
 	req.Header.Set("Accept-Encoding", "identity")
 
 	// make request
-	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
+	// eg. an error page, which must not be injected as script
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", res.StatusCode)
+	}
 
 	// read response
 	body, err := io.ReadAll(res.Body)
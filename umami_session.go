@@ -0,0 +1,52 @@
+package traefik_umami_plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// a session id is 16 random bytes, hex encoded.
+var sessionIdRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// generates a random, opaque session id.
+func randomSessionId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// returns the session id of the visitor for server side tracking.
+// reads it from the sessionCookieName cookie, or sets the cookie with a new id
+// on the response of a page, before the web service writes its headers.
+// returns an empty id if serverSideSessions is disabled or the host is not tracked.
+func (h *PluginHandler) serverSideSession(rw http.ResponseWriter, req *http.Request) string {
+	if !h.config.ServerSideSessions || !h.config.ServerSideTracking || !isTrackedDomain(req, &h.config) {
+		return ""
+	}
+	if cookie, err := req.Cookie(h.config.SessionCookieName); err == nil && sessionIdRegex.MatchString(cookie.Value) {
+		return cookie.Value
+	}
+	// only page navigations start a session, so parallel requests of assets don't race for the cookie
+	if !acceptsHTML(req) {
+		return ""
+	}
+	sessionId, err := randomSessionId()
+	if err != nil {
+		h.log(LogLevelWarn, "Could not generate a session id: "+err.Error())
+		return ""
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     h.config.SessionCookieName,
+		Value:    sessionId,
+		Path:     "/",
+		MaxAge:   int(h.sessionCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   forwardedScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return sessionId
+}
@@ -0,0 +1,44 @@
+package traefik_umami_plugin
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const udpSinkPrefix = "udp://"
+
+// serializes the writes of concurrent tracking requests to a file sink.
+var trackingSinkFileMu sync.Mutex
+
+// writes the body of the tracking request to the sink instead of sending it to umami.
+// the sink is a `udp://host:port` address or a file path, which gets one payload per line.
+func writeTrackingSink(sink string, trackingReq *http.Request) error {
+	payload, err := io.ReadAll(trackingReq.Body)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(sink, udpSinkPrefix) {
+		conn, err := net.Dial("udp", strings.TrimPrefix(sink, udpSinkPrefix))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write(payload)
+		return err
+	}
+
+	trackingSinkFileMu.Lock()
+	defer trackingSinkFileMu.Unlock()
+	file, err := os.OpenFile(sink, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(payload, '\n'))
+	return err
+}
@@ -0,0 +1,102 @@
+package traefik_umami_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats are the counters of a plugin instance since it was created.
+type Stats struct {
+	Requests         int64            `json:"requests"`
+	Injected         int64            `json:"injected"`
+	InjectionSkips   map[string]int64 `json:"injectionSkips"`
+	TrackingAttempts int64            `json:"trackingAttempts"`
+	Tracked          int64            `json:"tracked"`
+	TrackingFailures int64            `json:"trackingFailures"`
+	ForwardHits      int64            `json:"forwardHits"`
+	Errors           int64            `json:"errors"`
+	Dropped          int64            `json:"dropped"`
+}
+
+// statsCounters are updated atomically on the request path.
+type statsCounters struct {
+	requests         int64
+	injected         int64
+	skipped          int64
+	missingAnchor    int64
+	alreadyPresent   int64
+	reverted         int64
+	trackingAttempts int64
+	tracked          int64
+	trackingFailures int64
+	forwardHits      int64
+	errors           int64
+	dropped          int64
+}
+
+func (c *statsCounters) increment(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+// counts an injection outcome other than injectionInjected by its reason.
+func (c *statsCounters) incrementSkip(status string) {
+	switch status {
+	case injectionMissingAnchor:
+		c.increment(&c.missingAnchor)
+	case injectionAlreadyPresent:
+		c.increment(&c.alreadyPresent)
+	case injectionReverted:
+		c.increment(&c.reverted)
+	case injectionSkipped:
+		c.increment(&c.skipped)
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (h *PluginHandler) Stats() Stats {
+	return Stats{
+		Requests: atomic.LoadInt64(&h.stats.requests),
+		Injected: atomic.LoadInt64(&h.stats.injected),
+		InjectionSkips: map[string]int64{
+			injectionSkipped:        atomic.LoadInt64(&h.stats.skipped),
+			injectionMissingAnchor:  atomic.LoadInt64(&h.stats.missingAnchor),
+			injectionAlreadyPresent: atomic.LoadInt64(&h.stats.alreadyPresent),
+			injectionReverted:       atomic.LoadInt64(&h.stats.reverted),
+		},
+		TrackingAttempts: atomic.LoadInt64(&h.stats.trackingAttempts),
+		Tracked:          atomic.LoadInt64(&h.stats.tracked),
+		TrackingFailures: atomic.LoadInt64(&h.stats.trackingFailures),
+		ForwardHits:      atomic.LoadInt64(&h.stats.forwardHits),
+		Errors:           atomic.LoadInt64(&h.stats.errors),
+		Dropped:          atomic.LoadInt64(&h.stats.dropped),
+	}
+}
+
+// check if the request is for the stats endpoint, eg. `/_umami/stats`.
+func isStatsPath(req *http.Request, config *Config) bool {
+	if !config.StatsEnabled || config.ForwardPath == "" {
+		return false
+	}
+	return req.URL.Path == fmt.Sprintf("/%s/stats", config.ForwardPath)
+}
+
+// responds the counters as JSON.
+func (h *PluginHandler) serveStats(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	statsJson, err := json.Marshal(h.Stats())
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		rw.Write(statsJson)
+	}
+}
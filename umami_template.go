@@ -0,0 +1,119 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// values available in the script template file.
+type scriptTemplateData struct {
+	WebsiteId    string
+	HostUrl      string
+	ScriptSrc    string
+	ScriptJs     template.JS
+	Nonce        string
+	RoutePattern string
+	XHTML        bool // the page is XHTML, the markup must be well-formed XML
+}
+
+// a script template file, which can be reloaded while requests are served.
+type scriptTemplate struct {
+	mu           sync.RWMutex
+	path         string
+	tmpl         *template.Template
+	surrogateKey string
+}
+
+func loadScriptTemplate(path string) (*scriptTemplate, error) {
+	t := &scriptTemplate{path: path}
+	return t, t.reload()
+}
+
+// parses the template file again.
+// requests keep using the previous template until the new one is parsed completely.
+func (t *scriptTemplate) reload() error {
+	source, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New("script").Parse(string(source))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(source)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tmpl = tmpl
+	t.surrogateKey = "umami-" + hex.EncodeToString(sum[:8])
+	return nil
+}
+
+func (t *scriptTemplate) render(data scriptTemplateData) (string, error) {
+	t.mu.RLock()
+	tmpl := t.tmpl
+	t.mu.RUnlock()
+
+	var html bytes.Buffer
+	if err := tmpl.Execute(&html, data); err != nil {
+		return "", err
+	}
+	return html.String(), nil
+}
+
+// the surrogate key of the current template version.
+func (t *scriptTemplate) key() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.surrogateKey
+}
+
+// the template data of the script params.
+func (h *PluginHandler) scriptTemplateData(params scriptParams) scriptTemplateData {
+	hostUrl := scriptHostUrl(&h.config)
+	return scriptTemplateData{
+		WebsiteId:    params.websiteId,
+		HostUrl:      hostUrl,
+		ScriptSrc:    hostUrl + "/script.js",
+		ScriptJs:     template.JS(h.scriptJs),
+		Nonce:        params.nonce,
+		RoutePattern: params.routePattern,
+		XHTML:        params.xhtml,
+	}
+}
+
+// check if the request reloads the script template.
+func isTemplateReloadPath(req *http.Request, config *Config) bool {
+	if config.ScriptTemplateFile == "" || config.ScriptTemplateReloadToken == "" || config.ForwardPath == "" {
+		return false
+	}
+	return req.URL.Path == fmt.Sprintf("/%s/reload", config.ForwardPath)
+}
+
+// reloads the script template, if the request has the reload token.
+func (h *PluginHandler) serveTemplateReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.config.ScriptTemplateReloadToken)) != 1 {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := h.scriptTemplate.reload(); err != nil {
+		h.log(LogLevelError, fmt.Sprintf("scriptTemplateFile could not be reloaded: %+v", err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.log(LogLevelInfo, "scriptTemplateFile reloaded")
+	rw.WriteHeader(http.StatusNoContent)
+}
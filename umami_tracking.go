@@ -4,10 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type SendPayload struct {
@@ -15,9 +21,18 @@ type SendPayload struct {
 	Hostname string                 `json:"hostname"`
 	Language string                 `json:"language"`
 	Url      string                 `json:"url"`
-	Referer  string                 `json:"referer"`
+	Referrer string                 `json:"referrer"`
 	Name     string                 `json:"name"`
 	Data     map[string]interface{} `json:"data"`
+	Id       string                 `json:"id,omitempty"`
+}
+
+// per request values of a tracking event.
+type trackingEvent struct {
+	websiteId string
+	name      string // overrides the default event name
+	data      map[string]interface{}
+	sessionId string // of serverSideSessions, groups the events of a visitor
 }
 
 type SendBody struct {
@@ -25,13 +40,53 @@ type SendBody struct {
 	Type    string      `json:"type"`
 }
 
+// the payload of umami v1's /api/collect.
+type CollectPayloadV1 struct {
+	Website   string                 `json:"website"`
+	Hostname  string                 `json:"hostname"`
+	Language  string                 `json:"language"`
+	Url       string                 `json:"url"`
+	Referrer  string                 `json:"referrer"`
+	EventName string                 `json:"event_name"`
+	EventData map[string]interface{} `json:"event_data"`
+}
+
+type CollectBodyV1 struct {
+	Payload CollectPayloadV1 `json:"payload"`
+	Type    string           `json:"type"`
+}
+
+// converts the v2 body to v1, the event name and data are prefixed with `event_`.
+func buildCollectBodyV1(sendBody SendBody) CollectBodyV1 {
+	return CollectBodyV1{
+		Payload: CollectPayloadV1{
+			Website:   sendBody.Payload.Website,
+			Hostname:  sendBody.Payload.Hostname,
+			Language:  sendBody.Payload.Language,
+			Url:       sendBody.Payload.Url,
+			Referrer:  sendBody.Payload.Referrer,
+			EventName: sendBody.Payload.Name,
+			EventData: sendBody.Payload.Data,
+		},
+		Type: sendBody.Type,
+	}
+}
+
+// the path of umami's collect endpoint, `api/collect` before v2.
+func umamiCollectPath(config *Config) string {
+	if config.UmamiVersion == UVersion1 {
+		return "api/collect"
+	}
+	return "api/send"
+}
+
 func buildSendPayload(req *http.Request, websiteId string) SendPayload {
 	return SendPayload{
 		Website:  websiteId,
-		Hostname: parseDomainFromHost(req.Host),
+		Hostname: parseDomainFromHost(forwardedHost(req)),
 		Language: parseAcceptLanguage(req.Header.Get("Accept-Language")),
-		Url:      req.URL.String(),
-		Referer:  req.Referer(),
+		Url:      req.URL.RequestURI(),
+		Referrer: req.Referer(),
 		Name:     "traefik",
 		Data:     map[string]interface{}{},
 	}
@@ -49,20 +104,114 @@ func parseAcceptLanguage(acceptLanguage string) string {
 	return matches[0][1]
 }
 
-func buildTrackingRequest(clientReq *http.Request, config *Config) (*http.Request, error) {
+// lowercase User-Agent substrings of known bots, crawlers and http clients.
+var botUserAgents = []string{
+	"bot",
+	"crawler",
+	"spider",
+	"slurp",
+	"crawl",
+	"facebookexternalhit",
+	"headlesschrome",
+	"lighthouse",
+	"uptime",
+	"monitor",
+	"curl",
+	"wget",
+	"python-requests",
+	"go-http-client",
+	"okhttp",
+	"java/",
+}
+
+// check if the request is likely automated.
+// matches bot User-Agents or a request missing the headers every browser sends.
+func isBotRequest(req *http.Request, customBotUserAgents []string) bool {
+	if isBotUserAgent(req.UserAgent(), customBotUserAgents) {
+		return true
+	}
+	return req.Header.Get("Accept") == "" && req.Header.Get("Accept-Language") == ""
+}
+
+// check if the User-Agent is empty or contains one of the known
+// or custom bot User-Agents, case insensitive.
+func isBotUserAgent(userAgent string, customBotUserAgents []string) bool {
+	userAgent = strings.ToLower(userAgent)
+	if userAgent == "" {
+		return true
+	}
+	for _, botUserAgent := range botUserAgents {
+		if strings.Contains(userAgent, botUserAgent) {
+			return true
+		}
+	}
+	for _, botUserAgent := range customBotUserAgents {
+		if botUserAgent != "" && strings.Contains(userAgent, strings.ToLower(botUserAgent)) {
+			return true
+		}
+	}
+	return false
+}
+
+func buildTrackingRequest(clientReq *http.Request, config *Config, event trackingEvent) (*http.Request, error) {
 	// build body
 	sendBody := SendBody{
-		Payload: buildSendPayload(clientReq, config.WebsiteId),
+		Payload: buildSendPayload(clientReq, event.websiteId),
 		Type:    "event",
 	}
-	bodyJson, err := json.Marshal(sendBody)
+	if event.name != "" {
+		sendBody.Payload.Name = event.name
+	}
+	sendBody.Payload.Name = prefixedEventName(config, sendBody.Payload.Name)
+	for key, value := range event.data {
+		sendBody.Payload.Data[key] = value
+	}
+	sendBody.Payload.Url = trackingPageUrl(clientReq.URL, config)
+	if config.TrackAbsoluteUrls {
+		sendBody.Payload.Url = absoluteRequestUrl(clientReq, sendBody.Payload.Url)
+	}
+	if config.UseFirstDomainAsHostname && len(config.Domains) > 0 {
+		// the canonical hostname, eg. if the site is reached through several proxies
+		sendBody.Payload.Hostname = config.Domains[0]
+	}
+	if config.ServerSideTrackingReferrerHostOnly {
+		sendBody.Payload.Referrer = referrerHost(sendBody.Payload.Referrer)
+	} else if isStrippingQueryParams(config) {
+		sendBody.Payload.Referrer = stripReferrerQueryParams(sendBody.Payload.Referrer, config)
+	}
+	if config.ServerSideTrackingFlagBots && isBotRequest(clientReq, config.BotUserAgents) {
+		sendBody.Payload.Data["bot"] = true
+	}
+	if config.ServerSideTrackingParseUTM {
+		for key, value := range utmParams(clientReq.URL) {
+			sendBody.Payload.Data[key] = value
+		}
+	}
+	if event.sessionId != "" {
+		sendBody.Payload.Id = event.sessionId
+	}
+	if config.ServerSideTrackingVisitorHash {
+		// without the client IP, umami tells the visitors apart by the id
+		hash := visitorHash(clientReq, config.VisitorHashSalt, time.Now())
+		sendBody.Payload.Data["visitor"] = hash
+		if sendBody.Payload.Id == "" {
+			sendBody.Payload.Id = hash
+		}
+	}
+	var bodyJson []byte
+	var err error
+	if config.UmamiVersion == UVersion1 {
+		bodyJson, err = json.Marshal(buildCollectBodyV1(sendBody))
+	} else {
+		bodyJson, err = json.Marshal(sendBody)
+	}
 	if err != nil {
 		return nil, err
 	}
 	bodyReader := bytes.NewReader(bodyJson)
 
 	// build url
-	url := fmt.Sprintf("%s/api/send", config.UmamiHost)
+	url := fmt.Sprintf("%s/%s", config.UmamiHost, umamiCollectPath(config))
 
 	// build request
 	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bodyReader)
@@ -71,36 +220,188 @@ func buildTrackingRequest(clientReq *http.Request, config *Config) (*http.Reques
 	}
 
 	// set headers
-	req.Header.Set("Content-Type", "application/json")
+	// umami attributes the event to the User-Agent and the X-Forwarded-For client IP
 	copyHeaders(req.Header, clientReq.Header)
 	removeHeaders(req.Header, hopHeaders...)
+	stripForwardHeaders(req.Header, config)
 	writeXForwardedHeaders(req.Header, clientReq)
+	req.Header.Set("Content-Type", "application/json")
+	// set explicitly, so the default User-Agent of the go client is never sent
+	req.Header.Set("User-Agent", clientReq.UserAgent())
+	if config.ServerSideTrackingVisitorHash {
+		// the visitor hash replaces the client IP
+		removeHeaders(req.Header, clientIPHeaders...)
+	}
+	if config.ServerSideTrackingBearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.ServerSideTrackingBearerToken)
+	}
+	if (config.ServerSideTrackingReferrerHostOnly || isStrippingQueryParams(config)) && req.Header.Get("Referer") != "" {
+		req.Header.Set("Referer", sendBody.Payload.Referrer)
+	}
 
 	return req, nil
 }
 
-// send the tracking request to umami's /api/send.
-func sendTrackingRequest(trackingReq *http.Request) error {
+// a tracking request umami responded with a non 2xx status to.
+type trackingStatusError struct {
+	status int
+	reason string
+}
+
+func (e *trackingStatusError) Error() string {
+	if e.reason != "" {
+		return fmt.Sprintf("tracking request failed with status %d: %s", e.status, e.reason)
+	}
+	return fmt.Sprintf("tracking request failed with status %d", e.status)
+}
+
+// check if the tracking request may succeed if it is sent again,
+// eg. while umami restarts. other 4xx responses than a 429 are final.
+func isRetryableTrackingError(err error) bool {
+	var statusErr *trackingStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests
+	}
+	// connection errors and timeouts of the client, not errors of the sink
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// limits how much of umami's response is read.
+const maxTrackingErrorBodyBytes = 1024
+
+// send the tracking request to umami's collect endpoint.
+func sendTrackingRequest(trackingReq *http.Request, client *http.Client) error {
 	// make request
-	client := &http.Client{}
 	trackingRes, err := client.Do(trackingReq)
 	if err != nil {
 		return err
 	}
+	defer trackingRes.Body.Close()
 
+	// include umami's reason in the error, eg. for an unknown website id
 	status := trackingRes.StatusCode
 	if status < 200 || status >= 300 {
-		return fmt.Errorf("tracking request failed with status %d", status)
+		body, _ := io.ReadAll(io.LimitReader(trackingRes.Body, maxTrackingErrorBodyBytes))
+		return &trackingStatusError{status: status, reason: strings.TrimSpace(string(body))}
 	}
 
+	// drain the body, so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(trackingRes.Body, maxTrackingErrorBodyBytes))
 	return nil
 }
 
+// check if the umami host is umami cloud, which requires authentication.
+func isUmamiCloudHost(umamiHost string) bool {
+	u, err := url.Parse(umamiHost)
+	if err != nil {
+		return false
+	}
+	hostname := strings.ToLower(u.Hostname())
+	return hostname == "umami.is" || strings.HasSuffix(hostname, ".umami.is")
+}
+
+// the `utm_*` campaign parameters of the query, eg. `utm_source`.
+func utmParams(u *url.URL) map[string]string {
+	params := map[string]string{}
+	for key, values := range u.Query() {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") && len(values) > 0 && values[0] != "" {
+			params[strings.ToLower(key)] = values[0]
+		}
+	}
+	return params
+}
+
+// the url of the tracked page as sent to umami, the path and the query.
+func trackingPageUrl(u *url.URL, config *Config) string {
+	if isStrippingQueryParams(config) {
+		stripped := *u
+		stripped.RawQuery = stripQueryParams(u.RawQuery, config.StripQueryParams, config.StripAllQueryParams)
+		stripped.ForceQuery = false
+		u = &stripped
+	}
+	if config.PublicPathPrefix != "" {
+		return prefixUrlPath(u, config.PublicPathPrefix)
+	}
+	return u.RequestURI()
+}
+
+// check if query parameters are removed from the tracked urls.
+func isStrippingQueryParams(config *Config) bool {
+	return config.StripAllQueryParams || len(config.StripQueryParams) > 0
+}
+
+// removes the parameters with one of the names from the raw query, or all of them.
+// the other parameters are kept in their original order and encoding.
+func stripQueryParams(rawQuery string, names []string, all bool) string {
+	if all || rawQuery == "" {
+		return ""
+	}
+	kept := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		isStripped := false
+		for _, strippedName := range names {
+			if strings.EqualFold(name, strippedName) {
+				isStripped = true
+				break
+			}
+		}
+		if !isStripped {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// removes the stripped query parameters from the referrer.
+// a referrer that is not a valid url is dropped, as it can't be sanitized.
+func stripReferrerQueryParams(referrer string, config *Config) string {
+	if referrer == "" {
+		return ""
+	}
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = stripQueryParams(u.RawQuery, config.StripQueryParams, config.StripAllQueryParams)
+	u.ForceQuery = false
+	return u.String()
+}
+
+// prepends the prefix to the path of the url,
+// restoring the public path of a request whose prefix was stripped.
+func prefixUrlPath(u *url.URL, prefix string) string {
+	prefixed := *u
+	prefixed.Path = "/" + strings.Trim(prefix, "/") + "/" + strings.TrimPrefix(u.Path, "/")
+	prefixed.RawPath = ""
+	return prefixed.RequestURI()
+}
+
+// reduces the referrer to its scheme and host.
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+}
+
 // opts the port from the host.
+// the brackets of an IPv6 host are removed as well, eg. `[::1]:80` is `::1`.
 func parseDomainFromHost(host string) string {
 	// check if the host has a port
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
 	}
 	return host
 }
@@ -120,9 +421,69 @@ func hostnameInDomains(req *http.Request, domains []string) bool {
 	return false
 }
 
+// check if the host matches one of the glob patterns, case insensitive, eg. `*.example.com`.
+// if the list is empty, return true.
+func hostnameMatchesPatterns(req *http.Request, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	hostname := strings.ToLower(parseDomainFromHost(req.Host))
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, hostname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check if server side events are sent for the host of the request.
+// the host must be in the domains and match the trackDomains.
+func isTrackedDomain(req *http.Request, config *Config) bool {
+	return hostnameInDomains(req, config.Domains) && hostnameMatchesPatterns(req, config.TrackDomains)
+}
+
+// resolve the website id of the request.
+// uses the TLS server name (SNI) if it is in WebsiteIdBySNI,
+// then the host if it is in WebsiteIdMap,
+// otherwise falls back to the configured WebsiteId.
+func resolveWebsiteId(req *http.Request, config *Config) string {
+	if req.TLS != nil && req.TLS.ServerName != "" {
+		if websiteId, ok := config.WebsiteIdBySNI[strings.ToLower(req.TLS.ServerName)]; ok {
+			return websiteId
+		}
+	}
+	if websiteId, ok := config.WebsiteIdMap[strings.ToLower(parseDomainFromHost(req.Host))]; ok {
+		return websiteId
+	}
+	return config.WebsiteId
+}
+
+var statusClassRegex = regexp.MustCompile(`^[1-5]xx$`)
+
+// check if the status code is in one of the status classes, eg. `2xx`.
+// if the list is empty, return true.
+func isTrackedStatus(statusCode int, statusClasses []string) bool {
+	if len(statusClasses) == 0 {
+		return true
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	statusClass := fmt.Sprintf("%dxx", statusCode/100)
+	for _, class := range statusClasses {
+		if class == statusClass {
+			return true
+		}
+	}
+	return false
+}
+
 // check if server side tracking should be done.
 func shouldServerSideTrack(req *http.Request, config *Config, injected bool, h *PluginHandler) bool {
-	if config.ServerSideTracking && hostnameInDomains(req, config.Domains) {
+	if config.ServerSideTracking && isTrackedDomain(req, config) {
+		if config.FilterBots && isBotUserAgent(req.UserAgent(), config.BotUserAgents) {
+			return false
+		}
 		if config.ServerSideTrackingMode == SSTModeNotinjected {
 			return !injected
 		}
@@ -131,18 +492,118 @@ func shouldServerSideTrack(req *http.Request, config *Config, injected bool, h *
 	return false
 }
 
-func buildAndSendTrackingRequest(req *http.Request, config *Config) error {
+func buildAndSendTrackingRequest(ctx context.Context, req *http.Request, config *Config, event trackingEvent, client *http.Client) error {
 	// build tracking request
-	trackingReq, err := buildTrackingRequest(req, config)
+	trackingReq, err := buildTrackingRequest(req, config, event)
 	if err != nil {
 		return err
 	}
+	trackingReq = trackingReq.WithContext(ctx)
+
+	// write to the sink for local development
+	if config.ServerSideTrackingSink != "" {
+		return writeTrackingSink(config.ServerSideTrackingSink, trackingReq)
+	}
 
 	// send tracking request
-	err = sendTrackingRequest(trackingReq)
+	err = sendTrackingRequest(trackingReq, client)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// a summary of the tracking request for the audit log.
+// with the visitor hash, the client IP and the query are left out.
+func auditTrackingLine(req *http.Request, config *Config, event trackingEvent) string {
+	pageUrl := trackingPageUrl(req.URL, config)
+	ip := "forwarded"
+	if config.ServerSideTrackingVisitorHash {
+		if u, err := url.Parse(pageUrl); err == nil {
+			u.RawQuery = ""
+			pageUrl = u.String()
+		}
+		ip = "anonymized"
+	} else if clientIP, ok := parseRemoteAddrIP(req.RemoteAddr); ok {
+		ip = clientIP
+	}
+	return fmt.Sprintf("Tracking audit: %s %s/%s website=%s url=%s ip=%s",
+		http.MethodPost, config.UmamiHost, umamiCollectPath(config), event.websiteId, pageUrl, ip)
+}
+
+// send the event to the website id and the co-tracked websiteIds.
+func (h *PluginHandler) track(req *http.Request, event trackingEvent) {
+	for _, websiteId := range trackedWebsiteIds(&h.config, event.websiteId) {
+		websiteEvent := event
+		websiteEvent.websiteId = websiteId
+		h.trackWebsite(req, websiteEvent)
+	}
+}
+
+// send the tracking request and count the outcome.
+func (h *PluginHandler) trackWebsite(req *http.Request, event trackingEvent) {
+	if h.config.AuditTracking {
+		h.log(LogLevelInfo, auditTrackingLine(req, &h.config, event))
+	}
+	// the deadline caps a hit during an outage of umami, including the retries
+	// closing the workers cancels the request, so a shutdown doesn't wait for umami
+	ctx := context.Background()
+	if h.workers != nil {
+		ctx = h.workers.ctx
+	}
+	if h.trackingMaxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.trackingMaxLifetime)
+		defer cancel()
+	}
+	h.stats.increment(&h.stats.trackingAttempts)
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = h.sendTrackingAttempt(ctx, req, event)
+		if err == nil {
+			h.stats.increment(&h.stats.tracked)
+			return
+		}
+		if attempt >= h.config.TrackingRetries || !isRetryableTrackingError(err) || !h.waitForRetry(ctx, attempt) {
+			break
+		}
+	}
+	h.stats.increment(&h.stats.errors)
+	h.stats.increment(&h.stats.trackingFailures)
+	if errors.Is(err, context.DeadlineExceeded) {
+		h.log(LogLevelWarn, "Server side tracking timed out, dropping the event")
+		return
+	}
+	h.log(LogLevelWarn, fmt.Sprintf("Server side tracking failed, dropping the event: %+v", err))
+}
+
+// sends the tracking request once.
+func (h *PluginHandler) sendTrackingAttempt(ctx context.Context, req *http.Request, event trackingEvent) error {
+	// an unreachable umami must not keep the goroutine around
+	if h.config.TrackingTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.config.TrackingTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	return buildAndSendTrackingRequest(ctx, req, &h.config, event, h.umamiClient())
+}
+
+// waits the trackingRetryDelay, doubled for every attempt, before the next attempt.
+// returns false if the event expired or the workers were closed in the meantime.
+func (h *PluginHandler) waitForRetry(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(h.trackingRetryDelay << uint(attempt))
+	defer timer.Stop()
+	var closed chan struct{}
+	if h.workers != nil {
+		closed = h.workers.done
+	}
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-closed:
+		return false
+	}
+}
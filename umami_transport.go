@@ -0,0 +1,31 @@
+package traefik_umami_plugin
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// the values of umamiTLSMinVersion.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// idle connections kept open to umami.
+// the default of 2 makes busy sites reconnect for most events.
+const umamiMaxIdleConnsPerHost = 32
+
+// builds the transport shared by all requests to umami.
+func newUmamiTransport(minVersion uint16) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: minVersion}
+	transport.MaxIdleConnsPerHost = umamiMaxIdleConnsPerHost
+	return transport
+}
+
+// the client shared by all requests to umami.
+func (h *PluginHandler) umamiClient() *http.Client {
+	return h.umamiHttpClient
+}
@@ -0,0 +1,36 @@
+package traefik_umami_plugin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// headers revealing the client IP to umami.
+var clientIPHeaders = []string{
+	xForwardedFor,
+	"X-Real-Ip",
+	"Forwarded",
+	"Cf-Connecting-Ip",
+	"True-Client-Ip",
+}
+
+// generates a random salt, used if no visitorHashSalt is configured.
+func randomVisitorHashSalt() (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// an anonymous visitor identifier of the request.
+// the salt is rotated daily, so the hash can't be linked across days.
+func visitorHash(req *http.Request, salt string, now time.Time) string {
+	clientIP, _ := forwardedClientIP(req)
+	day := now.UTC().Format("2006-01-02")
+	sum := sha256.Sum256([]byte(salt + "|" + day + "|" + clientIP + "|" + req.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,130 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// events waiting for a tracking worker, further events are dropped.
+const trackingQueueSize = 1024
+
+// a server side event waiting in the queue.
+type trackingJob struct {
+	req   *http.Request
+	event trackingEvent
+}
+
+// the bounded pool sending the server side events.
+type trackingWorkers struct {
+	queue     chan trackingJob
+	draining  chan struct{}   // closed on shutdown, no new events are accepted
+	done      chan struct{}   // closed when the workers stop, the remaining events are dropped
+	ctx       context.Context // of the requests to umami, canceled with done
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// starts the workers, which send the queued events until the pool is closed.
+func (h *PluginHandler) startTrackingWorkers(workers int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.workers = &trackingWorkers{
+		queue:    make(chan trackingJob, trackingQueueSize),
+		draining: make(chan struct{}),
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for i := 0; i < workers; i++ {
+		h.workers.wg.Add(1)
+		go h.trackingWorker()
+	}
+}
+
+func (h *PluginHandler) trackingWorker() {
+	defer h.workers.wg.Done()
+	for {
+		select {
+		case <-h.workers.done:
+			return
+		case job := <-h.workers.queue:
+			h.track(job.req, job.event)
+		case <-h.workers.draining:
+			h.drainTrackingQueue()
+			return
+		}
+	}
+}
+
+// sends the remaining events, until the queue is empty or the workers stop.
+func (h *PluginHandler) drainTrackingQueue() {
+	for {
+		select {
+		case <-h.workers.done:
+			return
+		case job := <-h.workers.queue:
+			h.track(job.req, job.event)
+		default:
+			return
+		}
+	}
+}
+
+// queues the event for the workers without blocking the request.
+// the event is dropped if the queue is full or the pool is shutting down.
+func (h *PluginHandler) enqueueTracking(req *http.Request, event trackingEvent) {
+	if h.workers == nil {
+		h.stats.increment(&h.stats.dropped)
+		return
+	}
+	select {
+	case <-h.workers.draining:
+		h.stats.increment(&h.stats.dropped)
+		return
+	default:
+	}
+	select {
+	case h.workers.queue <- trackingJob{req: req, event: event}:
+	default:
+		h.stats.increment(&h.stats.dropped)
+	}
+}
+
+// Close stops the tracking workers, eg. when the plugin is embedded and torn down.
+// new events are dropped, the queued ones are sent for up to shutdownTimeoutSeconds,
+// events still in the queue after that are logged and dropped.
+func (h *PluginHandler) Close() error {
+	if h.workers == nil {
+		return nil
+	}
+	h.workers.closeOnce.Do(h.shutdownTrackingWorkers)
+	h.workers.wg.Wait()
+	return nil
+}
+
+func (h *PluginHandler) shutdownTrackingWorkers() {
+	close(h.workers.draining)
+	drained := make(chan struct{})
+	go func() {
+		h.workers.wg.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(time.Duration(h.config.ShutdownTimeoutSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+	}
+	// stops the workers, a pending retry or request to umami is given up
+	close(h.workers.done)
+	h.workers.cancel()
+	<-drained
+	if dropped := len(h.workers.queue); dropped > 0 {
+		atomic.AddInt64(&h.stats.dropped, int64(dropped))
+		h.log(LogLevelWarn, fmt.Sprintf("Dropped %d server side events still queued on shutdown", dropped))
+	}
+}